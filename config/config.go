@@ -6,70 +6,209 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io/ioutil"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/coinbase/memcachedbetween/hashring"
 )
 
 const defaultStatsdAddress = "localhost:8125"
 
 var validNetworks = []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket"}
+var validClearOnClasses = []string{"connect", "network", "timeout"}
 
 type Config struct {
+	args       []string // the command line, to parse again on reload
+	ConfigFile string
+
 	UpstreamConfigHost string
+	Upstreams          []string // static upstream addresses, used instead of the upstream config endpoint
+	SRV                string   // SRV record to discover upstreams from, instead of the upstream config endpoint
+	Resolver           string   // DNS server for SRV lookups, instead of the ones in /etc/resolv.conf
+	UpstreamsFile      string   // file listing upstream addresses, instead of the upstream config endpoint
 	LocalConfigHost    string
+	RefreshInterval    time.Duration
 
 	Network           string
 	LocalSocketPrefix string
 	LocalSocketSuffix string
 	LocalPortStart    int
 	Unlink            bool
+	Hashing           hashring.Algorithm
+
+	MinPoolSize     uint64
+	MaxPoolSize     uint64
+	CheckoutTimeout time.Duration // how long a request waits for an upstream connection, 0 for no limit
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxItemSize     int
+	Overrides       map[string]Upstream // by upstream address
+
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	ConnLifetime       time.Duration // how long an upstream connection is kept open, 0 for no limit
+	ConnLifetimeJitter time.Duration // up to how much earlier an upstream connection may be closed
+	ConnMaxRequests    uint64        // how many requests an upstream connection is used for, 0 for no limit
+
+	MaxDials       int           // upstream connections that can be dialed at once, 0 for no limit
+	DialBackoff    time.Duration // how long new upstream connections fail fast after a failed dial
+	MaxDialBackoff time.Duration
 
-	MinPoolSize  uint64
-	MaxPoolSize  uint64
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	ClearOn []string // classes of upstream errors that close all of the upstream's connections, of: connect, network, timeout
 
-	Pretty bool
-	Statsd string
-	Level  zapcore.Level
+	BreakerFailures    int
+	BreakerFailureRate float64
+	BreakerMinRequests int
+	BreakerWindow      time.Duration
+	BreakerOpenTimeout time.Duration
+	BreakerMiss        bool // answer retrievals with a miss instead of an error while the breaker is open
+
+	Retries      int           // times a request that failed on a dead upstream connection is forwarded again
+	RetryTimeout time.Duration // how long after a request was first forwarded it may still be retried
+
+	SASLUsername string
+	SASLPassword string
+	SASLFile     string
+
+	UpstreamTLS TLSConfig
+	ListenTLS   TLSConfig
+
+	Pretty     bool
+	Statsd     string
+	StatsdTags []string
+	Level      zapcore.Level
 }
 
 func ParseFlags() *Config {
-	config, err := parseFlags()
+	fs := newFlagSet()
+	config, err := parse(fs, os.Args[1:])
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		flag.Usage()
+		if err != flag.ErrHelp {
+			fmt.Printf("Error: %v\n", err)
+		}
+		fmt.Printf("Usage: %s [OPTIONS] [upstreamconfig]\n", os.Args[0])
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
 		os.Exit(2)
 	}
 	return config
 }
 
-func parseFlags() (*Config, error) {
-	flag.Usage = func() {
-		fmt.Printf("Usage: %s [OPTIONS] upstreamconfig\n", os.Args[0])
-		flag.PrintDefaults()
-	}
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
 
-	var network, localConfigHost, localSocketPrefix, localSocketSuffix, stats, loglevel string
-	var localPortStart int
+// parse parses the command line args with fs, and the config file if one is given. Flags on the command line take
+// precedence over the config file.
+func parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	var network, hashing, localConfigHost, localSocketPrefix, localSocketSuffix, stats, loglevel string
+	var upstreams, srv, resolver, upstreamsFile string
+	var saslUsername, saslPassword, saslFile string
+	var upstreamTLS, listenTLS bool
+	var listenTLSCAFile, listenTLSCertFile, listenTLSKeyFile, listenTLSMinVersion string
+	var upstreamTLSCAFile, upstreamTLSCertFile, upstreamTLSKeyFile, upstreamTLSServerName, upstreamTLSMinVersion string
+	var localPortStart, maxItemSize int
 	var minPoolSize, maxPoolSize uint64
-	var readTimeout, writeTimeout time.Duration
+	var checkoutTimeout, readTimeout, writeTimeout, refreshInterval time.Duration
+	var healthCheckInterval, healthCheckTimeout time.Duration
+	var connLifetime, connLifetimeJitter time.Duration
+	var connMaxRequests uint64
+	var maxDials int
+	var dialBackoff, maxDialBackoff time.Duration
+	var clearOn string
+	var breakerFailures, breakerMinRequests int
+	var breakerFailureRate float64
+	var breakerWindow, breakerOpenTimeout time.Duration
+	var breakerMiss bool
+	var retries int
+	var retryTimeout time.Duration
 	var pretty, unlink bool
-	flag.StringVar(&network, "network", "unix", "One of: tcp, tcp4, tcp6, unix or unixpacket")
-	flag.StringVar(&localConfigHost, "localconfig", ":11210", "Address to listen on for elasticache-like config server responses")
-	flag.StringVar(&localSocketPrefix, "localsocketprefix", "/var/tmp/memcachedbetween-", "Prefix to use for unix socket filenames")
-	flag.StringVar(&localSocketSuffix, "localsocketsuffix", ".sock", "Suffix to use for unix socket filenames")
-	flag.IntVar(&localPortStart, "localportstart", 11220, "Port number to start from for local proxies")
-	flag.BoolVar(&unlink, "unlink", false, "Unlink existing unix sockets before listening")
-	flag.Uint64Var(&minPoolSize, "minpoolsize", 0, "Min connection pool size")
-	flag.Uint64Var(&maxPoolSize, "maxpoolsize", 10, "Max connection pool size")
-	flag.DurationVar(&readTimeout, "readtimeout", 1*time.Second, "Read timeout")
-	flag.DurationVar(&writeTimeout, "writetimeout", 1*time.Second, "Write timeout")
-	flag.StringVar(&stats, "statsd", defaultStatsdAddress, "Statsd address")
-	flag.BoolVar(&pretty, "pretty", false, "Pretty print logging")
-	flag.StringVar(&loglevel, "loglevel", "info", "One of: debug, info, warn, error, dpanic, panic, fatal")
-
-	flag.Parse()
+	fs.StringVar(&network, "network", "unix", "One of: tcp, tcp4, tcp6, unix or unixpacket")
+	fs.StringVar(&upstreams, "upstreams", "", "Comma separated upstream addresses to proxy to instead of discovering them from the upstream config endpoint")
+	fs.StringVar(&srv, "srv", "", "Fully qualified DNS SRV record to discover upstreams from instead of the upstream config endpoint, resolved again when its TTL expires")
+	fs.StringVar(&resolver, "resolver", "", "DNS server address for SRV lookups (defaults to the servers in /etc/resolv.conf)")
+	fs.StringVar(&upstreamsFile, "upstreamsfile", "", "JSON (.json) array or whitespace separated list of upstream addresses to proxy to instead of the upstream config endpoint, read again when it changes")
+	fs.StringVar(&localConfigHost, "localconfig", ":11210", "Address to listen on for elasticache-like config server responses")
+	fs.DurationVar(&refreshInterval, "refreshinterval", 1*time.Minute, "How often to poll the upstream config endpoint or upstreams file for changes, or to retry failed SRV lookups (0 to disable)")
+	fs.StringVar(&localSocketPrefix, "localsocketprefix", "/var/tmp/memcachedbetween-", "Prefix to use for unix socket filenames")
+	fs.StringVar(&localSocketSuffix, "localsocketsuffix", ".sock", "Suffix to use for unix socket filenames")
+	fs.IntVar(&localPortStart, "localportstart", 11220, "Port number to start from for local proxies")
+	fs.BoolVar(&unlink, "unlink", false, "Unlink existing unix sockets before listening")
+	fs.StringVar(&hashing, "hashing", "", "Listen on a single local proxy that hashes keys to the cluster nodes instead of one per node, one of: ketama, dalli")
+	fs.Uint64Var(&minPoolSize, "minpoolsize", 0, "Min connection pool size")
+	fs.Uint64Var(&maxPoolSize, "maxpoolsize", 10, "Max connection pool size")
+	fs.DurationVar(&checkoutTimeout, "checkouttimeout", 0, "How long a request waits for an upstream connection when the pool is exhausted, before failing (0 for no limit)")
+	fs.DurationVar(&readTimeout, "readtimeout", 1*time.Second, "Read timeout")
+	fs.DurationVar(&writeTimeout, "writetimeout", 1*time.Second, "Write timeout")
+	fs.DurationVar(&healthCheckInterval, "healthcheckinterval", 0, "How often to send a noop on idle upstream connections, closing the ones that don't answer (0 to disable)")
+	fs.DurationVar(&healthCheckTimeout, "healthchecktimeout", 1*time.Second, "How long an idle upstream connection has to answer a health check")
+	fs.DurationVar(&connLifetime, "connlifetime", 0, "How long an upstream connection is kept open however busy it is, so that connections follow upstream address changes (0 for no limit)")
+	fs.DurationVar(&connLifetimeJitter, "connlifetimejitter", 0, "Up to how much earlier than connlifetime each upstream connection is closed, picked at random to spread out reconnects")
+	fs.Uint64Var(&connMaxRequests, "connmaxrequests", 0, "How many requests an upstream connection is used for before it is closed (0 for no limit)")
+	fs.IntVar(&maxDials, "maxdials", 0, "How many connections can be dialed to an upstream at once (0 for no limit)")
+	fs.DurationVar(&dialBackoff, "dialbackoff", 0, "How long new connections to an upstream fail fast after a dial failed, doubled for every failure in a row and jittered (0 to disable)")
+	fs.DurationVar(&maxDialBackoff, "maxdialbackoff", 10*time.Second, "The longest dialbackoff")
+	fs.StringVar(&clearOn, "clearon", "", "Comma separated classes of upstream errors that close all of the upstream's connections made before the error, of: connect, network, timeout (none by default)")
+	fs.IntVar(&breakerFailures, "breakerfailures", 0, "Consecutive upstream failures that open an upstream's circuit breaker, failing its requests fast (0 to disable)")
+	fs.Float64Var(&breakerFailureRate, "breakerfailurerate", 0, "Share of failed upstream requests within breakerwindow, from 0 to 1, that opens the circuit breaker (0 to disable)")
+	fs.IntVar(&breakerMinRequests, "breakerminrequests", 20, "Requests needed within breakerwindow before breakerfailurerate applies")
+	fs.DurationVar(&breakerWindow, "breakerwindow", 10*time.Second, "How long upstream requests are counted for breakerfailurerate")
+	fs.DurationVar(&breakerOpenTimeout, "breakeropentimeout", 5*time.Second, "How long an open circuit breaker waits before letting a request through to probe the upstream")
+	fs.BoolVar(&breakerMiss, "breakermiss", false, "Answer retrievals with a miss instead of a temporary failure while the circuit breaker is open")
+	fs.IntVar(&retries, "retries", 0, "Times a request that failed on a dead upstream connection is forwarded again on a new one, if it only reads or didn't reach the upstream (0 to disable)")
+	fs.DurationVar(&retryTimeout, "retrytimeout", 1*time.Second, "How long after a request was first forwarded it may still be retried")
+	fs.IntVar(&maxItemSize, "maxitemsize", 1024*1024, "Max item size in bytes, larger binary requests are rejected (0 for unlimited)")
+	fs.StringVar(&saslUsername, "saslusername", "", "Username for upstream SASL PLAIN authentication (defaults to $MEMCACHEDBETWEEN_SASL_USERNAME)")
+	fs.StringVar(&saslPassword, "saslpassword", "", "Password for upstream SASL PLAIN authentication (defaults to $MEMCACHEDBETWEEN_SASL_PASSWORD)")
+	fs.StringVar(&saslFile, "saslfile", "", "File containing username:password for upstream SASL PLAIN authentication, re-read for every new connection")
+	fs.BoolVar(&upstreamTLS, "upstreamtls", false, "Connect to upstream servers and the upstream config endpoint with TLS")
+	fs.StringVar(&upstreamTLSCAFile, "upstreamtlscafile", "", "CA bundle to verify upstream servers with (defaults to the system roots)")
+	fs.StringVar(&upstreamTLSCertFile, "upstreamtlscertfile", "", "Client certificate to present to upstream servers")
+	fs.StringVar(&upstreamTLSKeyFile, "upstreamtlskeyfile", "", "Client certificate key")
+	fs.StringVar(&upstreamTLSServerName, "upstreamtlsservername", "", "Server name to verify upstream certificates against (defaults to the upstream host)")
+	fs.StringVar(&upstreamTLSMinVersion, "upstreamtlsminversion", "1.2", "Minimum upstream TLS version, one of: 1.0, 1.1, 1.2, 1.3")
+	fs.BoolVar(&listenTLS, "listentls", false, "Terminate TLS on the local listeners")
+	fs.StringVar(&listenTLSCertFile, "listentlscertfile", "", "Certificate for the local listeners, reloaded when it changes")
+	fs.StringVar(&listenTLSKeyFile, "listentlskeyfile", "", "Certificate key for the local listeners, reloaded when it changes")
+	fs.StringVar(&listenTLSCAFile, "listentlscafile", "", "CA bundle to require and verify client certificates with, reloaded when it changes")
+	fs.StringVar(&listenTLSMinVersion, "listentlsminversion", "1.2", "Minimum local listener TLS version, one of: 1.0, 1.1, 1.2, 1.3")
+	fs.StringVar(&stats, "statsd", defaultStatsdAddress, "Statsd address")
+	fs.BoolVar(&pretty, "pretty", false, "Pretty print logging")
+	fs.StringVar(&loglevel, "loglevel", "info", "One of: debug, info, warn, error, dpanic, panic, fatal")
+
+	var configFile, statsdTags string
+	fs.StringVar(&configFile, "config", "", "YAML (.yaml, .yml) or TOML (.toml) file with settings named like these flags, and per upstream overrides. It is re-read on SIGHUP")
+	fs.StringVar(&statsdTags, "statsdtags", "", "Comma separated tags to add to request and pool metrics")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	upstreamConfigHost := fs.Arg(0)
+	var overrides map[string]map[string]string
+	if configFile != "" {
+		var err error
+		if upstreamConfigHost, overrides, err = applyFile(fs, configFile, upstreamConfigHost); err != nil {
+			return nil, err
+		}
+	}
+
+	// The SASL credentials default to the environment after parsing, so that they aren't printed with the defaults.
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["saslusername"] {
+		saslUsername = os.Getenv("MEMCACHEDBETWEEN_SASL_USERNAME")
+	}
+	if !set["saslpassword"] {
+		saslPassword = os.Getenv("MEMCACHEDBETWEEN_SASL_PASSWORD")
+	}
 
 	level := zap.InfoLevel
 	if loglevel != "" {
@@ -79,33 +218,148 @@ func parseFlags() (*Config, error) {
 		}
 	}
 
-	upstreamConfigHost := flag.Arg(0)
-	if len(upstreamConfigHost) == 0 {
+	upstreamList := splitList(upstreams)
+	sources := 0
+	for _, set := range []bool{upstreamConfigHost != "", len(upstreamList) > 0, srv != "", upstreamsFile != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources == 0 {
 		return nil, errors.New("missing upstream config address")
 	}
+	if sources > 1 {
+		return nil, errors.New("only one of an upstream config address, upstreams, srv or upstreamsfile can be given")
+	}
 
 	if !validNetwork(network) {
 		return nil, fmt.Errorf("invalid network: %s", network)
 	}
 
+	if hashing != "" && !validHashing(hashring.Algorithm(hashing)) {
+		return nil, fmt.Errorf("invalid hashing: %s", hashing)
+	}
+
+	if breakerFailureRate < 0 || breakerFailureRate > 1 {
+		return nil, fmt.Errorf("invalid breakerfailurerate: %v", breakerFailureRate)
+	}
+
+	for _, class := range splitList(clearOn) {
+		if !validClearOn(class) {
+			return nil, fmt.Errorf("invalid clearon: %s", class)
+		}
+	}
+
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid retries: %d", retries)
+	}
+
+	if saslFile != "" && (saslUsername != "" || saslPassword != "") {
+		return nil, errors.New("saslfile cannot be combined with saslusername or saslpassword")
+	}
+
+	minVersion, err := parseTLSVersion(upstreamTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	upstreamTLSConfig := TLSConfig{
+		Enabled:    upstreamTLS,
+		CAFile:     upstreamTLSCAFile,
+		CertFile:   upstreamTLSCertFile,
+		KeyFile:    upstreamTLSKeyFile,
+		ServerName: upstreamTLSServerName,
+		MinVersion: minVersion,
+	}
+	if err = upstreamTLSConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	listenMinVersion, err := parseTLSVersion(listenTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	listenTLSConfig := TLSConfig{
+		Enabled:    listenTLS,
+		CAFile:     listenTLSCAFile,
+		CertFile:   listenTLSCertFile,
+		KeyFile:    listenTLSKeyFile,
+		MinVersion: listenMinVersion,
+	}
+	if err = listenTLSConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	upstreamOverrides, err := parseOverrides(overrides, Upstream{
+		MinPoolSize:  minPoolSize,
+		MaxPoolSize:  maxPoolSize,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
+		args:       args,
+		ConfigFile: configFile,
+
 		UpstreamConfigHost: upstreamConfigHost,
+		Upstreams:          upstreamList,
+		SRV:                srv,
+		Resolver:           resolver,
+		UpstreamsFile:      upstreamsFile,
 		LocalConfigHost:    localConfigHost,
+		RefreshInterval:    refreshInterval,
 
 		Network:           network,
 		LocalSocketPrefix: localSocketPrefix,
 		LocalSocketSuffix: localSocketSuffix,
 		LocalPortStart:    localPortStart,
 		Unlink:            unlink,
+		Hashing:           hashring.Algorithm(hashing),
 
-		MinPoolSize:  minPoolSize,
-		MaxPoolSize:  maxPoolSize,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+		MinPoolSize:     minPoolSize,
+		MaxPoolSize:     maxPoolSize,
+		CheckoutTimeout: checkoutTimeout,
+		ReadTimeout:     readTimeout,
+		WriteTimeout:    writeTimeout,
+		MaxItemSize:     maxItemSize,
+		Overrides:       upstreamOverrides,
+
+		HealthCheckInterval: healthCheckInterval,
+		HealthCheckTimeout:  healthCheckTimeout,
+
+		ConnLifetime:       connLifetime,
+		ConnLifetimeJitter: connLifetimeJitter,
+		ConnMaxRequests:    connMaxRequests,
+
+		MaxDials:       maxDials,
+		DialBackoff:    dialBackoff,
+		MaxDialBackoff: maxDialBackoff,
+
+		ClearOn: splitList(clearOn),
 
-		Pretty: pretty,
-		Statsd: stats,
-		Level:  level,
+		BreakerFailures:    breakerFailures,
+		BreakerFailureRate: breakerFailureRate,
+		BreakerMinRequests: breakerMinRequests,
+		BreakerWindow:      breakerWindow,
+		BreakerOpenTimeout: breakerOpenTimeout,
+		BreakerMiss:        breakerMiss,
+
+		Retries:      retries,
+		RetryTimeout: retryTimeout,
+
+		SASLUsername: saslUsername,
+		SASLPassword: saslPassword,
+		SASLFile:     saslFile,
+
+		UpstreamTLS: upstreamTLSConfig,
+		ListenTLS:   listenTLSConfig,
+
+		Pretty:     pretty,
+		Statsd:     stats,
+		StatsdTags: splitList(statsdTags),
+		Level:      level,
 	}, nil
 }
 
@@ -117,3 +371,31 @@ func validNetwork(network string) bool {
 	}
 	return false
 }
+
+func validHashing(algorithm hashring.Algorithm) bool {
+	for _, a := range hashring.Algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+func validClearOn(class string) bool {
+	for _, c := range validClearOnClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	var split []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			split = append(split, item)
+		}
+	}
+	return split
+}
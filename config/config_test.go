@@ -0,0 +1,167 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// writeFile writes contents to a file called name in a temporary directory, returning its path
+func writeFile(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "memcachedbetween")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestParseYAMLFile(t *testing.T) {
+	path := writeFile(t, "memcachedbetween.yaml", `
+upstreamconfig: cluster.example.com:11211
+network: tcp4
+maxpoolsize: 20
+readtimeout: 2s
+statsdtags: [env:test, team:cache]
+overrides:
+  Node1.example.com:11211:
+    maxpoolsize: 50
+    writetimeout: 3s
+`)
+	cfg, err := parse(newFlagSet(), []string{"-config", path, "-network", "tcp"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster.example.com:11211", cfg.UpstreamConfigHost)
+	assert.Equal(t, "tcp", cfg.Network) // the command line wins
+	assert.Equal(t, uint64(20), cfg.MaxPoolSize)
+	assert.Equal(t, []string{"env:test", "team:cache"}, cfg.StatsdTags)
+
+	assert.Equal(t, Upstream{MaxPoolSize: 50, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second}, cfg.Upstream("node1.example.com:11211"))
+	assert.Equal(t, Upstream{MaxPoolSize: 20, ReadTimeout: 2 * time.Second, WriteTimeout: time.Second}, cfg.Upstream("node2.example.com:11211"))
+}
+
+func TestParseTOMLFile(t *testing.T) {
+	path := writeFile(t, "memcachedbetween.toml", `
+loglevel = "debug"
+minpoolsize = 2
+
+[overrides."node1.example.com:11211"]
+minpoolsize = 5
+`)
+	cfg, err := parse(newFlagSet(), []string{"-config", path, "cluster.example.com:11211"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster.example.com:11211", cfg.UpstreamConfigHost)
+	assert.Equal(t, zap.DebugLevel, cfg.Level)
+	assert.Equal(t, uint64(2), cfg.MinPoolSize)
+	assert.Equal(t, uint64(5), cfg.Upstream("node1.example.com:11211").MinPoolSize)
+}
+
+func TestParseInvalidFile(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown.yaml":  "bogus: 1\n",
+		"invalid.yaml":  "maxpoolsize: many\n",
+		"nested.yaml":   "config: other.yaml\n",
+		"override.yaml": "overrides:\n  a:11211:\n    network: tcp\n",
+		"format.json":   "{}",
+	} {
+		_, err := parse(newFlagSet(), []string{"-config", writeFile(t, name, contents), "cluster.example.com:11211"})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeFile(t, "memcachedbetween.yaml", "maxpoolsize: 10\nnetwork: tcp\n")
+	cfg, err := parse(newFlagSet(), []string{"-config", path, "cluster.example.com:11211"})
+	assert.NoError(t, err)
+	rc := NewReloadable(cfg)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxpoolsize: 30\nnetwork: tcp4\nloglevel: warn\n"), 0600))
+	restart, err := rc.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Network"}, restart)
+	assert.Equal(t, uint64(30), rc.Get().MaxPoolSize)
+	assert.Equal(t, zap.WarnLevel, rc.Get().Level)
+	assert.Equal(t, "tcp", rc.Get().Network)
+	assert.Equal(t, uint64(10), cfg.MaxPoolSize)
+
+	// an invalid file keeps the current config
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxpoolsize: -1\n"), 0600))
+	_, err = rc.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, uint64(30), rc.Get().MaxPoolSize)
+}
+
+func TestParseUpstreams(t *testing.T) {
+	cfg, err := parse(newFlagSet(), []string{"-upstreams", "a:11211, b:11211"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.UpstreamConfigHost)
+	assert.Equal(t, []string{"a:11211", "b:11211"}, cfg.Upstreams)
+
+	path := writeFile(t, "memcachedbetween.yaml", "upstreams:\n  - a:11211\n  - b:11211\n")
+	cfg, err = parse(newFlagSet(), []string{"-config", path})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:11211", "b:11211"}, cfg.Upstreams)
+
+	_, err = parse(newFlagSet(), []string{"-upstreams", "a:11211", "cluster.example.com:11211"})
+	assert.Error(t, err)
+	_, err = parse(newFlagSet(), []string{"-upstreams", "a:11211", "-srv", "_memcache._tcp.cache.local"})
+	assert.Error(t, err)
+	_, err = parse(newFlagSet(), []string{})
+	assert.Error(t, err)
+
+	_, err = parse(newFlagSet(), []string{"-upstreamsfile", "nodes.json", "cluster.example.com:11211"})
+	assert.Error(t, err)
+
+	cfg, err = parse(newFlagSet(), []string{"-srv", "_memcache._tcp.cache.local", "-resolver", "127.0.0.1:5353"})
+	assert.NoError(t, err)
+	assert.Equal(t, "_memcache._tcp.cache.local", cfg.SRV)
+	assert.Equal(t, "127.0.0.1:5353", cfg.Resolver)
+}
+
+func TestParseClearOn(t *testing.T) {
+	cfg, err := parse(newFlagSet(), []string{"cluster.example.com:11211"})
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.ClearOn)
+
+	cfg, err = parse(newFlagSet(), []string{"-clearon", "connect, timeout", "cluster.example.com:11211"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"connect", "timeout"}, cfg.ClearOn)
+
+	_, err = parse(newFlagSet(), []string{"-clearon", "everything", "cluster.example.com:11211"})
+	assert.Error(t, err)
+}
+
+func TestSASLFromEnvironment(t *testing.T) {
+	for name, value := range map[string]string{"MEMCACHEDBETWEEN_SASL_USERNAME": "user", "MEMCACHEDBETWEEN_SASL_PASSWORD": "secret"} {
+		assert.NoError(t, os.Setenv(name, value))
+		name := name
+		t.Cleanup(func() { _ = os.Unsetenv(name) })
+	}
+
+	fs := newFlagSet()
+	cfg, err := parse(fs, []string{"-saslusername", "admin", "cluster.example.com:11211"})
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", cfg.SASLUsername)
+	assert.Equal(t, "secret", cfg.SASLPassword)
+
+	var defaults strings.Builder
+	fs.SetOutput(&defaults)
+	fs.PrintDefaults()
+	assert.NotContains(t, defaults.String(), "secret")
+}
+
+func TestOptInDefaults(t *testing.T) {
+	// behaviors that change how requests fail are off unless they are configured
+	cfg, err := parse(newFlagSet(), []string{"cluster.example.com:11211"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), cfg.CheckoutTimeout)
+	assert.Equal(t, 0, cfg.Retries)
+	assert.Equal(t, 0, cfg.MaxDials)
+	assert.Equal(t, time.Duration(0), cfg.DialBackoff)
+	assert.Empty(t, cfg.ClearOn)
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// upstreamConfigKey is the config file key for the upstream config address, which is an argument on the command line
+const upstreamConfigKey = "upstreamconfig"
+
+// overridesKey is the config file key for per upstream settings
+const overridesKey = "overrides"
+
+// Upstream contains the pool and timeout settings for a single upstream
+type Upstream struct {
+	MinPoolSize  uint64
+	MaxPoolSize  uint64
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// Upstream returns the settings for the upstream at address, which are the global settings unless they are
+// overridden in the config file
+func (c *Config) Upstream(address string) Upstream {
+	if u, ok := c.Overrides[strings.ToLower(address)]; ok {
+		return u
+	}
+	return Upstream{
+		MinPoolSize:  c.MinPoolSize,
+		MaxPoolSize:  c.MaxPoolSize,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
+}
+
+// applyFile sets the flags of fs that weren't set on the command line from the config file at path. It returns the
+// upstream config address, which is only read from the file if it wasn't given on the command line, and the per
+// upstream overrides.
+func applyFile(fs *flag.FlagSet, path string, upstreamConfigHost string) (string, map[string]map[string]string, error) {
+	settings, err := readFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var overrides map[string]map[string]string
+	for key, value := range settings {
+		switch key {
+		case upstreamConfigKey:
+			if upstreamConfigHost == "" {
+				upstreamConfigHost = fmt.Sprint(value)
+			}
+		case overridesKey:
+			if overrides, err = fileOverrides(value); err != nil {
+				return "", nil, err
+			}
+		case "config":
+			return "", nil, errors.New("config files can't include other config files")
+		default:
+			if fs.Lookup(key) == nil {
+				return "", nil, fmt.Errorf("unknown setting in %s: %s", path, key)
+			}
+			if set[key] {
+				continue
+			}
+			if err := fs.Set(key, fileValue(value)); err != nil {
+				return "", nil, fmt.Errorf("invalid %s in %s: %v", key, path, err)
+			}
+		}
+	}
+	return upstreamConfigHost, overrides, nil
+}
+
+// readFile decodes the YAML or TOML config file at path, depending on its extension
+func readFile(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var m map[interface{}]interface{}
+		if err = yaml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		for k, v := range m {
+			settings[fmt.Sprint(k)] = v
+		}
+	case ".toml":
+		if _, err = toml.Decode(string(b), &settings); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config file format: %s", path)
+	}
+	return settings, nil
+}
+
+// fileValue formats a config file value as a flag value. Lists are joined with commas.
+func fileValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		var values []string
+		for _, v := range list {
+			values = append(values, fmt.Sprint(v))
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// fileOverrides returns the settings of each upstream in the overrides section of a config file
+func fileOverrides(value interface{}) (map[string]map[string]string, error) {
+	upstreams, ok := fileMap(value)
+	if !ok {
+		return nil, fmt.Errorf("%s must map upstream addresses to settings", overridesKey)
+	}
+
+	overrides := map[string]map[string]string{}
+	for address, value := range upstreams {
+		settings, ok := fileMap(value)
+		if !ok {
+			return nil, fmt.Errorf("%s for %s must be a map of settings", overridesKey, address)
+		}
+		overrides[address] = map[string]string{}
+		for key, value := range settings {
+			overrides[address][key] = fileValue(value)
+		}
+	}
+	return overrides, nil
+}
+
+// fileMap returns value as a map with string keys, if it is a map in a YAML or TOML file
+func fileMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for k, v := range m {
+			converted[fmt.Sprint(k)] = v
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+// parseOverrides parses the per upstream settings, which default to the global settings in defaults
+func parseOverrides(overrides map[string]map[string]string, defaults Upstream) (map[string]Upstream, error) {
+	parsed := map[string]Upstream{}
+	for address, settings := range overrides {
+		u := defaults
+		for key, value := range settings {
+			var err error
+			switch key {
+			case "minpoolsize":
+				u.MinPoolSize, err = strconv.ParseUint(value, 10, 64)
+			case "maxpoolsize":
+				u.MaxPoolSize, err = strconv.ParseUint(value, 10, 64)
+			case "readtimeout":
+				u.ReadTimeout, err = time.ParseDuration(value)
+			case "writetimeout":
+				u.WriteTimeout, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("unknown setting in %s for %s: %s", overridesKey, address, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in %s for %s: %v", key, overridesKey, address, err)
+			}
+		}
+		parsed[strings.ToLower(address)] = u
+	}
+	return parsed, nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// runtimeFields are the Config fields that are applied without a restart when the config is reloaded
+var runtimeFields = map[string]bool{
+	"Level":           true,
+	"MinPoolSize":     true,
+	"MaxPoolSize":     true,
+	"CheckoutTimeout": true,
+	"ReadTimeout":     true,
+	"WriteTimeout":    true,
+	"MaxItemSize":     true,
+	"Overrides":       true,
+	"StatsdTags":      true,
+	"BreakerMiss":     true,
+	"Retries":         true,
+	"RetryTimeout":    true,
+}
+
+// Reloadable holds the current Config, which is replaced when the config file is reloaded
+type Reloadable struct {
+	current atomic.Value
+}
+
+// NewReloadable returns a Reloadable with cfg as the current config
+func NewReloadable(cfg *Config) *Reloadable {
+	r := &Reloadable{}
+	r.current.Store(cfg)
+	return r
+}
+
+// Get returns the current config. It must not be modified.
+func (r *Reloadable) Get() *Config {
+	return r.current.Load().(*Config)
+}
+
+// Reload parses the command line and config file again, and makes a config with the changes to runtime fields
+// current. The names of the other fields that changed, which need a restart to be applied, are returned.
+func (r *Reloadable) Reload() ([]string, error) {
+	old := r.Get()
+	parsed, err := parse(newFlagSet(), old.args)
+	if err != nil {
+		return nil, err
+	}
+
+	next := *old
+	var restart []string
+	o, p, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(parsed).Elem(), reflect.ValueOf(&next).Elem()
+	for i := 0; i < o.NumField(); i++ {
+		field := o.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if reflect.DeepEqual(o.Field(i).Interface(), p.Field(i).Interface()) {
+			continue
+		}
+		if runtimeFields[field.Name] {
+			n.Field(i).Set(p.Field(i))
+		} else {
+			restart = append(restart, field.Name)
+		}
+	}
+
+	r.current.Store(&next)
+	return restart, nil
+}
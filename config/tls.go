@@ -0,0 +1,204 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often certificate files are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig contains the files and settings used to build a tls.Config
+type TLSConfig struct {
+	Enabled    bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	MinVersion uint16
+}
+
+// ClientConfig returns the tls.Config for connecting to upstream servers, or nil if TLS is disabled. Without a CA
+// file the system roots are used.
+func (t TLSConfig) ClientConfig() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: t.MinVersion,
+	}
+
+	if t.CAFile != "" {
+		pool, err := loadCertPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// ServerConfig returns the tls.Config for listeners, or nil if TLS is disabled. Client certificates are required and
+// verified against the CA file if one is set. The certificate, key and CA files are reloaded when they change, so
+// certificates can be rotated without restarting listeners. Reload errors are passed to reloadFailed, and keep the
+// previous certificates in place until the files change again.
+func (t TLSConfig) ServerConfig(reloadFailed func(error)) (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+	if t.CertFile == "" {
+		return nil, errors.New("a tls certificate is required to listen with tls")
+	}
+
+	r := &tlsReloader{config: t, reloadFailed: reloadFailed}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: t.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.get(), nil
+		},
+	}, nil
+}
+
+// tlsReloader holds the current server tls.Config, rebuilding it when the underlying files change
+type tlsReloader struct {
+	config       TLSConfig
+	reloadFailed func(error)
+
+	mu       sync.Mutex
+	current  *tls.Config
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.CAFile != "" {
+		files = append(files, r.config.CAFile)
+	}
+	return files
+}
+
+// get returns the current tls.Config, reloading it first if the files have changed. Reload errors keep the
+// previous config in place.
+func (r *tlsReloader) get() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= tlsReloadInterval {
+		r.checked = time.Now()
+		if r.changed() {
+			if err := r.loadLocked(); err != nil && r.reloadFailed != nil {
+				r.reloadFailed(err)
+			}
+		}
+	}
+	return r.current
+}
+
+func (r *tlsReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	return r.loadLocked()
+}
+
+func (r *tlsReloader) changed() bool {
+	for i, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tlsReloader) loadLocked() error {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	// Files that fail to load aren't loaded again until they change, such as when a rotation is completed.
+	r.modTimes = modTimes
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	c := &tls.Config{
+		MinVersion:   r.config.MinVersion,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.config.CAFile != "" {
+		pool, err := loadCertPool(r.config.CAFile)
+		if err != nil {
+			return err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.current = c
+	return nil
+}
+
+func (t TLSConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("a tls certificate and key must be configured together")
+	}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("invalid tls version: %s", version)
+	}
+	return v, nil
+}
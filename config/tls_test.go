@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSReloadFailure(t *testing.T) {
+	certFile := writeFile(t, "cert.pem", "not a certificate")
+	keyFile := writeFile(t, "key.pem", "not a key")
+
+	var failures []error
+	r := &tlsReloader{
+		config:       TLSConfig{CertFile: certFile, KeyFile: keyFile},
+		reloadFailed: func(err error) { failures = append(failures, err) },
+		modTimes:     []time.Time{{}, {}},
+	}
+	assert.Nil(t, r.get())
+	assert.Len(t, failures, 1)
+
+	// files that failed to load aren't loaded again until they change
+	r.checked = time.Time{}
+	assert.Nil(t, r.get())
+	assert.Len(t, failures, 1)
+}
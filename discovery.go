@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/config"
+	"github.com/coinbase/memcachedbetween/dnssrv"
+	"github.com/coinbase/memcachedbetween/elasticache"
+	"github.com/coinbase/memcachedbetween/nodefile"
+)
+
+// watchFunc watches a discovery source until stop is closed, calling read with the nodes whenever it reads them.
+// The nodes may not have changed since they were last read.
+type watchFunc func(read func(nodes []string), stop chan interface{})
+
+// discover reads the upstream nodes from the configured discovery source. It also returns a watchFunc for the
+// source, or nil if the nodes are static or refreshing is disabled.
+func discover(log *zap.Logger, cfg *config.Config, upstreamTLS *tls.Config) ([]string, watchFunc, error) {
+	switch {
+	case cfg.UpstreamConfigHost != "":
+		cluster, err := elasticache.ClusterConfig(log, cfg.UpstreamConfigHost, upstreamTLS)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("Config read", zap.Int("version", cluster.Version), zap.Strings("servers", cluster.Nodes))
+		if cfg.RefreshInterval <= 0 {
+			return cluster.Nodes, nil, nil
+		}
+		return cluster.Nodes, func(read func([]string), stop chan interface{}) {
+			elasticache.Watch(log, cfg.UpstreamConfigHost, upstreamTLS, cfg.RefreshInterval, cluster.Version, func(c *elasticache.Cluster) {
+				read(c.Nodes)
+			}, stop)
+		}, nil
+
+	case cfg.SRV != "":
+		nodes, ttl, err := dnssrv.Lookup(cfg.SRV, cfg.Resolver)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("SRV record resolved", zap.String("srv", cfg.SRV), zap.Strings("servers", nodes))
+		if cfg.RefreshInterval <= 0 {
+			return nodes, nil, nil
+		}
+		return nodes, func(read func([]string), stop chan interface{}) {
+			dnssrv.Watch(log, cfg.SRV, cfg.Resolver, cfg.RefreshInterval, ttl, read, stop)
+		}, nil
+
+	case cfg.UpstreamsFile != "":
+		nodes, err := nodefile.Read(cfg.UpstreamsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("Node file read", zap.String("path", cfg.UpstreamsFile), zap.Strings("servers", nodes))
+		return nodes, func(read func([]string), stop chan interface{}) {
+			nodefile.Watch(log, cfg.UpstreamsFile, cfg.RefreshInterval, read, stop)
+		}, nil
+	}
+
+	log.Info("Static upstreams", zap.Strings("servers", cfg.Upstreams))
+	return cfg.Upstreams, nil, nil
+}
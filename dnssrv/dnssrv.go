@@ -0,0 +1,133 @@
+package dnssrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// minTTL is the shortest time Watch waits between lookups, so records with a zero TTL aren't resolved in a loop
+const minTTL = 1 * time.Second
+
+// resolvConf is read for the DNS servers when no resolver is given
+const resolvConf = "/etc/resolv.conf"
+
+// Lookup resolves the SRV record name with the DNS server at resolver, or the servers in /etc/resolv.conf if
+// resolver is empty. It returns the targets as sorted host:port addresses, and the lowest TTL of the records.
+// The name isn't expanded with search domains.
+func Lookup(name string, resolver string) ([]string, time.Duration, error) {
+	servers, err := resolvers(resolver)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+
+	err = errors.New("no DNS servers")
+	for _, server := range servers {
+		var r *dns.Msg
+		if r, err = exchange(m, server); err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("SRV lookup of %s failed: %s", name, dns.RcodeToString[r.Rcode])
+		}
+		return parseTargets(name, r)
+	}
+	return nil, 0, err
+}
+
+// Watch resolves name again when the TTL of the last answer expires, until stop is closed, and calls resolved with
+// the targets of every answer. Failed lookups are logged and retried after interval.
+func Watch(l *zap.Logger, name string, resolver string, interval time.Duration, ttl time.Duration, resolved func([]string), stop chan interface{}) {
+	for {
+		if ttl < minTTL {
+			ttl = minTTL
+		}
+		timer := time.NewTimer(ttl)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		targets, t, err := Lookup(name, resolver)
+		if err != nil {
+			l.Warn("Failed to refresh SRV record", zap.String("srv", name), zap.Error(err))
+			ttl = interval
+			continue
+		}
+		ttl = t
+		l.Debug("SRV record resolved", zap.String("srv", name), zap.Strings("servers", targets))
+		resolved(targets)
+	}
+}
+
+// resolvers returns the addresses of the DNS servers to query
+func resolvers(resolver string) ([]string, error) {
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		return []string{resolver}, nil
+	}
+
+	c, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, server := range c.Servers {
+		servers = append(servers, net.JoinHostPort(server, c.Port))
+	}
+	return servers, nil
+}
+
+// exchange sends m to server over UDP, and again over TCP if the answer was truncated
+func exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	r, _, err := new(dns.Client).Exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+	if r.Truncated {
+		r, _, err = (&dns.Client{Net: "tcp"}).Exchange(m, server)
+	}
+	return r, err
+}
+
+// parseTargets returns the targets and lowest TTL of the SRV records in r. An answer without records is an error,
+// so a broken record doesn't remove every node.
+func parseTargets(name string, r *dns.Msg) ([]string, time.Duration, error) {
+	var targets []string
+	var ttl time.Duration
+	seen := map[string]bool{}
+	for _, rr := range r.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		recordTTL := time.Duration(srv.Hdr.Ttl) * time.Second
+		if len(seen) == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		target := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records for %s", name)
+	}
+	sort.Strings(targets)
+	return targets, ttl, nil
+}
@@ -0,0 +1,102 @@
+package dnssrv
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// stubServer answers SRV queries with the current records
+type stubServer struct {
+	records []dns.RR
+	sync.Mutex
+}
+
+func (s *stubServer) set(records ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.records = nil
+	for _, record := range records {
+		rr, _ := dns.NewRR(record)
+		s.records = append(s.records, rr)
+	}
+}
+
+func (s *stubServer) start(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		s.Lock()
+		m.Answer = s.records
+		s.Unlock()
+		if len(m.Answer) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestLookup(t *testing.T) {
+	s := &stubServer{}
+	s.set(
+		"_memcache._tcp.cache.local. 30 IN SRV 0 0 11211 b.cache.local.",
+		"_memcache._tcp.cache.local. 10 IN SRV 0 0 11212 a.cache.local.",
+	)
+	resolver := s.start(t)
+
+	targets, ttl, err := Lookup("_memcache._tcp.cache.local", resolver)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.cache.local:11212", "b.cache.local:11211"}, targets)
+	assert.Equal(t, 10*time.Second, ttl)
+
+	s.set()
+	_, _, err = Lookup("_memcache._tcp.cache.local", resolver)
+	assert.Error(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	s := &stubServer{}
+	s.set("_memcache._tcp.cache.local. 0 IN SRV 0 0 11211 a.cache.local.")
+	resolver := s.start(t)
+
+	_, ttl, err := Lookup("_memcache._tcp.cache.local", resolver)
+	assert.NoError(t, err)
+
+	changes := make(chan []string, 10)
+	stop := make(chan interface{})
+	defer close(stop)
+	go Watch(zap.NewNop(), "_memcache._tcp.cache.local", resolver, time.Second, ttl, func(targets []string) {
+		changes <- targets
+	}, stop)
+
+	s.set(
+		"_memcache._tcp.cache.local. 0 IN SRV 0 0 11211 a.cache.local.",
+		"_memcache._tcp.cache.local. 0 IN SRV 0 0 11211 b.cache.local.",
+	)
+	for {
+		select {
+		case targets := <-changes:
+			if len(targets) == 1 {
+				continue // resolved before the record changed
+			}
+			assert.Equal(t, []string{"a.cache.local:11211", "b.cache.local:11211"}, targets)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "targets didn't change")
+		}
+		return
+	}
+}
@@ -2,23 +2,35 @@ package elasticache
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-// ClusterNodes Reads from the elasticache config node (endpoint) and
-//
-//	returns a slice of memcache node addresses
-func ClusterNodes(l *zap.Logger, endpoint string) ([]string, error) {
+// timeout bounds dialing the config endpoint and reading its answer, so a hung endpoint fails the refresh instead
+// of stopping it
+var timeout = 10 * time.Second
+
+// Cluster is the cluster configuration returned by a config endpoint
+type Cluster struct {
+	// Version is incremented by ElastiCache whenever the nodes change
+	Version int
+	Nodes   []string
+}
+
+// ClusterConfig reads the version and node addresses from the elasticache config node (endpoint). The endpoint
+// is dialed with TLS if tlsConfig is not nil.
+func ClusterConfig(l *zap.Logger, endpoint string, tlsConfig *tls.Config) (*Cluster, error) {
 	if !strings.Contains(endpoint, ":") {
 		endpoint = endpoint + ":11211"
 	}
-	conn, err := net.Dial("tcp", endpoint)
+	conn, err := dial(endpoint, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -29,13 +41,16 @@ func ClusterNodes(l *zap.Logger, endpoint string) ([]string, error) {
 		}
 	}()
 
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
 	command := "config get cluster\r\n"
 	_, err = fmt.Fprint(conn, command)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := parseNodes(conn)
+	version, response, err := parseNodes(conn)
 	if err != nil {
 		return nil, err
 	}
@@ -45,10 +60,47 @@ func ClusterNodes(l *zap.Logger, endpoint string) ([]string, error) {
 		return nil, err
 	}
 
-	return urls, nil
+	return &Cluster{Version: version, Nodes: urls}, nil
 }
 
-func parseNodes(conn io.Reader) (string, error) {
+// Watch polls the config endpoint every interval until stop is closed, and calls changed with the cluster
+// configuration whenever its version differs from version, the version that was last read. Errors polling the
+// endpoint are logged and skipped.
+func Watch(l *zap.Logger, endpoint string, tlsConfig *tls.Config, interval time.Duration, version int, changed func(*Cluster), stop chan interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c, err := ClusterConfig(l, endpoint, tlsConfig)
+		if err != nil {
+			l.Warn("Failed to refresh cluster config", zap.Error(err))
+			continue
+		}
+		if c.Version == version {
+			continue
+		}
+		l.Debug("Cluster config version changed", zap.Int("version", c.Version), zap.Strings("servers", c.Nodes))
+		changed(c)
+		version = c.Version
+	}
+}
+
+func dial(endpoint string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", endpoint)
+	}
+	return tls.DialWithDialer(dialer, "tcp", endpoint, tlsConfig)
+}
+
+func parseNodes(conn io.Reader) (int, string, error) {
+	var version int
 	var response string
 
 	count := 0
@@ -57,6 +109,12 @@ func parseNodes(conn io.Reader) (string, error) {
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		count++
+		if count == location-1 {
+			var err error
+			if version, err = strconv.Atoi(scanner.Text()); err != nil {
+				return 0, "", fmt.Errorf("invalid config version: %s", scanner.Text())
+			}
+		}
 		if count == location {
 			response = scanner.Text()
 		}
@@ -66,10 +124,10 @@ func parseNodes(conn io.Reader) (string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return "", err
+		return 0, "", err
 	}
 
-	return response, nil
+	return version, response, nil
 }
 
 func parseURLs(response string) ([]string, error) {
@@ -79,6 +137,9 @@ func parseURLs(response string) ([]string, error) {
 
 	for _, v := range items {
 		fields := strings.Split(v, "|")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid node in cluster config: %s", v)
+		}
 
 		port, err := strconv.Atoi(fields[2])
 		if err != nil {
@@ -0,0 +1,111 @@
+package elasticache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeConfigEndpoint answers config get cluster with the current version and nodes
+type fakeConfigEndpoint struct {
+	version int
+	nodes   string
+	sync.Mutex
+}
+
+func (f *fakeConfigEndpoint) set(version int, nodes string) {
+	f.Lock()
+	defer f.Unlock()
+	f.version, f.nodes = version, nodes
+}
+
+func (f *fakeConfigEndpoint) start(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+					return
+				}
+				f.Lock()
+				body := fmt.Sprintf("%d\r\n%s\r\n", f.version, f.nodes)
+				f.Unlock()
+				_, _ = fmt.Fprintf(conn, "CONFIG cluster 0 %d\r\n%s\r\nEND\r\n", len(body), body)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l.Addr().String()
+}
+
+func TestClusterConfig(t *testing.T) {
+	f := &fakeConfigEndpoint{version: 12, nodes: "a.cache|10.0.0.1|11211 b.cache|10.0.0.2|11212"}
+	endpoint := f.start(t)
+
+	c, err := ClusterConfig(zap.NewNop(), endpoint, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, c.Version)
+	assert.Equal(t, []string{"a.cache:11211", "b.cache:11212"}, c.Nodes)
+
+	f.set(13, "a.cache")
+	_, err = ClusterConfig(zap.NewNop(), endpoint, nil)
+	assert.Error(t, err)
+}
+
+func TestClusterConfigTimeout(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 50 * time.Millisecond
+
+	// an endpoint that never answers fails the read instead of blocking it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	start := time.Now()
+	_, err = ClusterConfig(zap.NewNop(), l.Addr().String(), nil)
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWatch(t *testing.T) {
+	f := &fakeConfigEndpoint{version: 1, nodes: "a.cache|10.0.0.1|11211"}
+	endpoint := f.start(t)
+
+	changes := make(chan *Cluster, 10)
+	stop := make(chan interface{})
+	defer close(stop)
+	go Watch(zap.NewNop(), endpoint, nil, 10*time.Millisecond, 1, func(c *Cluster) {
+		changes <- c
+	}, stop)
+
+	// nodes are only reported when the version changes
+	f.set(1, "b.cache|10.0.0.2|11211")
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, changes)
+
+	f.set(2, "a.cache|10.0.0.1|11211 b.cache|10.0.0.2|11211")
+	select {
+	case c := <-changes:
+		assert.Equal(t, 2, c.Version)
+		assert.Equal(t, []string{"a.cache:11211", "b.cache:11211"}, c.Nodes)
+	case <-time.After(time.Second):
+		assert.Fail(t, "no change")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, changes)
+}
@@ -3,8 +3,12 @@ module github.com/coinbase/memcachedbetween
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/DataDog/datadog-go v4.2.0+incompatible
 	github.com/coinbase/mongobetween v0.0.9
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/miekg/dns v1.1.41
+	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.16.0
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// retrievalOpcodes are the opcodes of requests that only read values
+var retrievalOpcodes = map[protocol.Opcode]bool{
+	protocol.OpGet:   true,
+	protocol.OpGetQ:  true,
+	protocol.OpGetK:  true,
+	protocol.OpGetKQ: true,
+	protocol.OpGAT:   true,
+	protocol.OpGATQ:  true,
+	protocol.OpGATK:  true,
+	protocol.OpGATKQ: true,
+}
+
+// idempotentOpcodes are the opcodes of requests that can safely be sent to the server again if it isn't known
+// whether they were executed
+var idempotentOpcodes = map[protocol.Opcode]bool{
+	protocol.OpGet:     true,
+	protocol.OpGetQ:    true,
+	protocol.OpGetK:    true,
+	protocol.OpGetKQ:   true,
+	protocol.OpGAT:     true,
+	protocol.OpGATQ:    true,
+	protocol.OpGATK:    true,
+	protocol.OpGATKQ:   true,
+	protocol.OpTouch:   true,
+	protocol.OpNoop:    true,
+	protocol.OpVersion: true,
+	protocol.OpStat:    true,
+}
+
+// header decodes the header of a binary protocol message that has already been read in full
+func header(wm []byte) protocol.Header {
+	h, _ := protocol.DecodeHeader(wm)
+	return h
+}
+
+// requestKey returns the key of a binary protocol request that has already been read in full, or nil if it has none
+func requestKey(wm []byte) []byte {
+	h := header(wm)
+	if h.KeyLength == 0 {
+		return nil
+	}
+	start := protocol.HeaderLen + int(h.ExtrasLength)
+	return wm[start : start+int(h.KeyLength)]
+}
+
+// finalResponse returns true if h is the header of the last response the server will send for a pipeline.
+// Responses to quiet requests always precede the response to the non-quiet request that terminated the
+// pipeline, and stat responses are terminated by a response with an empty key.
+func finalResponse(h protocol.Header) bool {
+	if h.Opcode.Quiet() {
+		return false
+	}
+	if h.Opcode == protocol.OpStat && h.KeyLength > 0 {
+		return false
+	}
+	return true
+}
+
+// noopRequest returns a noop request that carries the same opaque as the request with header h
+func noopRequest(h protocol.Header) []byte {
+	return protocol.NewRequest(protocol.OpNoop, h.Opaque, nil, nil, nil).Encode()
+}
+
+// quitResponse returns a successful response to the quit request with header h
+func quitResponse(h protocol.Header) []byte {
+	return protocol.NewResponse(protocol.OpQuit, protocol.StatusNoError, h.Opaque, nil, nil, nil).Encode()
+}
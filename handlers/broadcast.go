@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// broadcastOpcodes are the binary requests without a key that concern every server, so they are forwarded to all
+// of the servers when keys are spread across several. Stat requests are rejected instead, since the stats of
+// several servers can't be told apart in a single response.
+var broadcastOpcodes = map[protocol.Opcode]bool{
+	protocol.OpFlush:     true,
+	protocol.OpFlushQ:    true,
+	protocol.OpVerbosity: true,
+	protocol.OpVersion:   true,
+}
+
+// broadcastCommands are the text commands that are forwarded to every server, like broadcastOpcodes
+var broadcastCommands = map[string]bool{
+	"flush_all": true,
+	"verbosity": true,
+	"version":   true,
+}
+
+var errStatsNotSupported = textResponseError("SERVER_ERROR stats aren't supported across several servers")
+
+// spanningServers returns the servers that a request without a key that concerns every server is forwarded to, or
+// nil if route only picks a single server, so the request is routed like any other
+func (c *connection) spanningServers() []*pool.Server {
+	if servers := c.servers(); len(servers) > 1 {
+		return servers
+	}
+	return nil
+}
+
+// spansServers reports whether the binary request wm is answered by broadcastRoundTrip
+func (c *connection) spansServers(wm []byte) bool {
+	op := header(wm).Opcode
+	return (broadcastOpcodes[op] || op == protocol.OpStat) && c.spanningServers() != nil
+}
+
+// broadcastRoundTrip forwards the binary request wm to every server, and answers it with the first error, or else
+// with the response of the first server. Quiet requests are forwarded as their non-quiet version, so that their
+// success is known, and are only answered with errors.
+func (c *connection) broadcastRoundTrip(wm []byte) error {
+	h := header(wm)
+	if h.Opcode == protocol.OpStat {
+		return WriteWireMessage(c.ctx, c.log, protocol.NewErrorResponse(h, protocol.StatusNotSupported, "Not supported").Encode(), c.conn, c.address, c.id, 0, c.conn.Close)
+	}
+
+	req := append([]byte(nil), wm...)
+	if h.Opcode == protocol.OpFlushQ {
+		req[1] = byte(protocol.OpFlush)
+	}
+	var res []byte
+	for _, server := range c.spanningServers() {
+		r := c.binaryExchange(server, req)
+		if res == nil || (header(res).Status == protocol.StatusNoError && header(r).Status != protocol.StatusNoError) {
+			res = r
+		}
+	}
+	if h.Opcode.Quiet() && header(res).Status == protocol.StatusNoError {
+		return nil
+	}
+	res[1] = byte(h.Opcode)
+	return WriteWireMessage(c.ctx, c.log, res, c.conn, c.address, c.id, 0, c.conn.Close)
+}
+
+// binaryExchange forwards the binary request wm, which is answered with a single response, to server and returns
+// the response, or an error response if the request can't be forwarded or answered
+func (c *connection) binaryExchange(server *pool.Server, wm []byte) []byte {
+	conn, err := c.checkoutConnection(server)
+	if err != nil {
+		return c.failedResponse(wm, err)
+	}
+	var upstreamErr error
+	defer func() {
+		if upstreamErr != nil {
+			// There may be an unread response on the wire, so the connection can't be reused.
+			_ = conn.Close()
+		}
+		server.Report(conn, upstreamErr)
+		_ = conn.Return()
+	}()
+
+	address := conn.Address().String()
+	upstreamCfg := c.cfg.Upstream(address)
+	if upstreamErr = WriteWireMessage(c.ctx, c.log, wm, conn.Conn(), address, conn.ID(), upstreamCfg.WriteTimeout, conn.Close); upstreamErr != nil {
+		c.upstreamFailed(c.log, upstreamErr)
+		return c.failedResponse(wm, upstreamErr)
+	}
+	var res []byte
+	if res, upstreamErr = ReadWireMessage(c.ctx, c.log, nil, conn.Conn(), address, conn.ID(), upstreamCfg.ReadTimeout, protocol.MagicResponse, 0, conn.Close); upstreamErr != nil {
+		c.upstreamFailed(c.log, upstreamErr)
+		return c.failedResponse(wm, upstreamErr)
+	}
+	return res
+}
+
+// textSpansServers reports whether the text request req is answered by textBroadcastRoundTrip
+func (c *connection) textSpansServers(req *textRequest) bool {
+	return (broadcastCommands[req.command] || req.command == "stats") && c.spanningServers() != nil
+}
+
+// textBroadcastRoundTrip forwards the text request req to every server, and answers it like broadcastRoundTrip.
+// noreply requests are forwarded without noreply, and their errors are dropped like memcached does.
+func (c *connection) textBroadcastRoundTrip(req *textRequest) error {
+	if req.command == "stats" {
+		return c.writeTextError(errStatsNotSupported)
+	}
+
+	sub := req
+	if req.noreply {
+		fields := bytes.Fields(req.wm)
+		sub = &textRequest{
+			wm:      append(bytes.Join(fields[:len(fields)-1], []byte(" ")), crlf...),
+			command: req.command,
+		}
+	}
+	var res []byte
+	for _, server := range c.spanningServers() {
+		_, r, err := c.textExchange(server, sub)
+		if err != nil {
+			return err
+		}
+		if res == nil || (!textError(res) && textError(r)) {
+			res = r
+		}
+	}
+	if req.noreply {
+		return nil
+	}
+	return WriteWireMessage(c.ctx, c.log, res, c.conn, c.address, c.id, 0, c.conn.Close)
+}
+
+// textError reports whether res is a text protocol error response
+func textError(res []byte) bool {
+	return bytes.HasPrefix(res, []byte("ERROR")) || bytes.HasPrefix(res, []byte("CLIENT_ERROR")) || bytes.HasPrefix(res, []byte("SERVER_ERROR"))
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"runtime/debug"
 	"time"
@@ -14,38 +17,62 @@ import (
 
 	"github.com/coinbase/memcachedbetween/config"
 	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/memcachedbetween/protocol"
 )
 
 type connection struct {
-	log    *zap.Logger
-	statsd *statsd.Client
-	cfg    *config.Config
+	log        *zap.Logger
+	statsd     *statsd.Client
+	reloadable *config.Reloadable
+	cfg        *config.Config // the current config, loaded for every message
 
+	// ctx is cancelled when the client hangs up or the connection is killed, which stops waiting for upstreams
 	ctx     context.Context
-	conn    net.Conn
+	cancel  context.CancelFunc
+	conn    *bufferedConn
 	address string
 	id      uint64
-	server  *pool.Server
-	kill    chan interface{}
+	peer    string
+	route   Router
+	servers func() []*pool.Server // every server that route picks from
+
+	// pending is a text request that was read from the client but is routed to another server than the
+	// pipeline it was read with, so it is handled as the next message
+	pending *textRequest
 }
 
-func CommandConnection(log *zap.Logger, sd *statsd.Client, cfg *config.Config, conn net.Conn, address string, id uint64, server *pool.Server, kill chan interface{}) {
+// CommandConnection proxies the commands on conn to the servers that route picks for them. Commands without a key
+// that concern every server, like flush_all, are forwarded to all of the servers returned by servers. peer is the
+// verified identity of the client, if any, and is added to metrics.
+func CommandConnection(log *zap.Logger, sd *statsd.Client, cfg *config.Reloadable, conn net.Conn, address string, id uint64, peer string, route Router, servers func() []*pool.Server, kill chan interface{}) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Error("Connection crashed", zap.String("panic", fmt.Sprintf("%v", r)), zap.String("stack", string(debug.Stack())))
 		}
 	}()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-kill:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	c := connection{
-		log:     log,
-		statsd:  sd,
-		cfg:     cfg,
-		ctx:     context.Background(),
-		conn:    conn,
-		address: address,
-		id:      id,
-		server:  server,
-		kill:    kill,
+		log:        log,
+		statsd:     sd,
+		reloadable: cfg,
+		ctx:        ctx,
+		cancel:     cancel,
+		conn:       newBufferedConn(conn),
+		address:    address,
+		id:         id,
+		peer:       peer,
+		route:      route,
+		servers:    servers,
 	}
 	c.processMessages()
 }
@@ -56,8 +83,8 @@ func (c *connection) processMessages() {
 		if err != nil {
 			if err != io.EOF {
 				select {
-				case <-c.kill:
-					// ignore errors from force shutdown
+				case <-c.ctx.Done():
+					// ignore errors from force shutdown or a client that hung up
 				default:
 					log.Error("Error handling message", zap.Error(err))
 				}
@@ -68,62 +95,446 @@ func (c *connection) processMessages() {
 }
 
 func (c *connection) handleMessage() (log *zap.Logger, err error) {
+	c.cfg = c.reloadable.Get()
+
+	var opcode string
 	defer func(start time.Time) {
-		_ = c.statsd.Timing("handle_message", time.Since(start), []string{
+		tags := append([]string{
 			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		}, c.cfg.StatsdTags...)
+		if opcode != "" {
+			tags = append(tags, fmt.Sprintf("opcode:%s", opcode))
+		}
+		if c.peer != "" {
+			tags = append(tags, fmt.Sprintf("peer:%s", c.peer))
+		}
+		_ = c.statsd.Timing("handle_message", time.Since(start), tags, 1)
 	}(time.Now())
 
 	log = c.log
 
+	if c.pending != nil {
+		log, err = c.handleTextMessage()
+		return
+	}
+
+	var magic []byte
+	if magic, err = c.conn.Peek(1); err != nil {
+		return
+	}
+	if magic[0] != protocol.MagicRequest {
+		log, err = c.handleTextMessage()
+		return
+	}
+
 	var wm []byte
-	if wm, err = ReadWireMessage(c.ctx, log, wm, c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+	if wm, err = ReadWireMessage(c.ctx, log, wm, c.conn, c.address, c.id, 0, protocol.MagicRequest, c.cfg.MaxItemSize, c.conn.Close); err != nil {
+		if herr, ok := err.(*protocol.HeaderError); ok {
+			err = c.respondHeaderError(herr)
+		}
 		return
 	}
+	opcode = header(wm).Opcode.String()
 
-	if wm, log, err = c.roundTrip(wm); err != nil {
+	if header(wm).Opcode.Quit() {
+		err = c.quit(wm)
 		return
 	}
 
-	err = WriteWireMessage(c.ctx, log, wm, c.conn, c.address, c.id, 0, c.conn.Close)
+	log, err = c.roundTrip(wm)
 	return
 }
 
-func (c *connection) roundTrip(wm []byte) (res []byte, log *zap.Logger, err error) {
+// roundTrip forwards a pipeline of requests starting with wm, splitting it wherever the requests are routed to
+// another server, or concern every server.
+func (c *connection) roundTrip(wm []byte) (log *zap.Logger, err error) {
 	log = c.log
+	for wm != nil {
+		if c.spansServers(wm) {
+			err = c.broadcastRoundTrip(wm)
+			return
+		}
+		if log, wm, err = c.serverRoundTrip(wm); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// binaryPipeline is a pipeline of binary requests that serverRoundTrip forwards to a single server
+type binaryPipeline struct {
+	server *pool.Server
+	// requests are the requests read from the client so far. The pipeline ends after a request that isn't quiet,
+	// or is terminated by a noop in place of the request that followed the last one.
+	requests [][]byte
+	// quit is the quit request that terminated the pipeline, if any. It is replaced with a noop upstream,
+	// because quitting would close the pooled connection. Requests with an invalid header that the client can
+	// recover from are also replaced with a noop, and answered with an error after the responses to the pipeline.
+	// Other invalid headers close the client connection, so the pipeline isn't answered at all. next is a request
+	// for a key on another server, which is returned to be forwarded next.
+	quit []byte
+	herr *protocol.HeaderError
+	next []byte
+	// idle is set if the client hadn't sent the request following the last quiet one yet. Waiting for it would
+	// keep the upstream connection checked out for as long as the client likes, so the pipeline is terminated with
+	// a noop instead, and the client's next request starts a new pipeline.
+	idle bool
+	// written is the number of requests written upstream, and answered the number that were answered by the
+	// server in order. responded is set once a response has been forwarded to the client.
+	written   int
+	answered  int
+	responded bool
+}
+
+// terminator returns the noop that terminates p in place of the request following the last one, if any
+func (p *binaryPipeline) terminator() []byte {
+	switch {
+	case p.quit != nil:
+		return noopRequest(header(p.quit))
+	case p.herr != nil:
+		return noopRequest(p.herr.Header)
+	case p.next != nil:
+		return noopRequest(header(p.next))
+	case p.idle:
+		return noopRequest(header(p.requests[len(p.requests)-1]))
+	}
+	return nil
+}
+
+// ended reports whether all of the requests in p have been read from the client
+func (p *binaryPipeline) ended() bool {
+	return p.terminator() != nil || !header(p.requests[len(p.requests)-1]).Opcode.Quiet()
+}
 
-	var conn pool.ConnectionWrapper
-	if conn, err = c.checkoutConnection(); err != nil {
+// answer records the response res, which answers the request it belongs to along with the quiet requests before
+// it, which won't be answered any more because the server handles requests in order. Responses are matched by
+// position rather than by opaque alone, since clients may use the same opaque for every request: a final
+// response answers the next request that isn't quiet, or the terminating noop, and a quiet response the first
+// quiet request before that with the same opcode and opaque, and the same key if the response has one. Only the
+// last response to a request answers it, so a failure while stats are streamed still terminates the stats.
+func (p *binaryPipeline) answer(res []byte) {
+	h := header(res)
+	if !h.Opcode.Quiet() && !finalResponse(h) {
 		return
 	}
+	final, key := !h.Opcode.Quiet(), requestKey(res)
+	for i := p.answered; i < p.written; i++ {
+		rh := header(p.requests[i])
+		switch {
+		case !rh.Opcode.Quiet():
+			if final {
+				p.answered = i + 1
+			}
+			return
+		case !final && rh.Opcode == h.Opcode && rh.Opaque == h.Opaque && (key == nil || bytes.Equal(key, requestKey(p.requests[i]))):
+			p.answered = i + 1
+			return
+		}
+	}
+	if final {
+		p.answered = p.written
+	}
+}
+
+// replayable reports whether p can be forwarded again after its upstream failed. Nothing may have been forwarded
+// to the client yet, and the requests that reached the server must be idempotent. A request that was written in
+// part isn't executed by the server, so it is safe to write again.
+func (p *binaryPipeline) replayable() bool {
+	if p.responded {
+		return false
+	}
+	for _, wm := range p.requests[:p.written] {
+		if !idempotentOpcodes[header(wm).Opcode] {
+			return false
+		}
+	}
+	return true
+}
+
+// serverRoundTrip forwards a pipeline of requests starting with wm to a single upstream connection. Quiet
+// requests are forwarded for as long as the client has the next request buffered, until a non-quiet request
+// terminates the pipeline, and every response is streamed back to the client until the response to the
+// terminating request arrives. If a quiet request is followed by a request for a key on another server, or
+// by nothing yet, the pipeline is terminated with a noop instead, and the request for the other server is
+// returned as next. A pipeline that failed on a dead connection is
+// forwarded again on a new one if that is safe, and otherwise requests that can't be forwarded or answered get
+// error responses, so the client connection stays usable.
+func (c *connection) serverRoundTrip(wm []byte) (log *zap.Logger, next []byte, err error) {
+	log = c.log
+
+	p := &binaryPipeline{server: c.route(requestKey(wm)), requests: [][]byte{wm}}
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		var conn pool.ConnectionWrapper
+		if conn, err = c.checkoutConnection(p.server); err != nil {
+			// failing fast is expected while the upstream is down, so it is only reported in metrics
+			if err != pool.ErrCircuitOpen && err != pool.ErrBackingOff {
+				log.Warn("Failed to check out connection", zap.Error(err))
+			}
+			if attempt > 0 {
+				c.retried("", false)
+			}
+			next, err = c.failPipeline(p, err)
+			return
+		}
+		address := conn.Address().String()
+
+		var upstreamErr error
+		if log, upstreamErr, err = c.forward(conn, p); err != nil {
+			return
+		}
+		if attempt > 0 {
+			c.retried(address, upstreamErr == nil)
+		}
+		if upstreamErr == nil {
+			next, err = c.endPipeline(p)
+			return
+		}
+		if !c.retry(attempt, start, upstreamErr) || !p.replayable() {
+			c.upstreamFailed(log, upstreamErr)
+			next, err = c.failPipeline(p, upstreamErr)
+			return
+		}
+		log.Debug("Retrying pipeline", zap.Error(upstreamErr))
+	}
+}
+
+// forward writes p to conn, reading the rest of the pipeline from the client as needed, and streams the
+// responses back to the client. upstreamErr is the error reading or writing conn, if any, and err the error
+// reading or writing the client connection.
+func (c *connection) forward(conn pool.ConnectionWrapper, p *binaryPipeline) (log *zap.Logger, upstreamErr, err error) {
+	drained := false
 	defer func() {
+		if !drained {
+			// There may be unread responses on the wire, so the connection can't be reused.
+			_ = conn.Close()
+		}
+		p.server.Report(conn, upstreamErr)
 		_ = conn.Return()
 	}()
 
 	log = c.log.With(zap.Uint64("upstream_id", conn.ID()))
 	log.Debug("Connection checked out")
+	address := conn.Address().String()
+	upstreamCfg := c.cfg.Upstream(address)
 
-	if err = WriteWireMessage(c.ctx, log, wm, conn.Conn(), conn.Address().String(), conn.ID(), c.cfg.WriteTimeout, conn.Close); err != nil {
-		return
+	p.written = 0
+	for {
+		if p.written < len(p.requests) {
+			if upstreamErr = WriteWireMessage(c.ctx, log, p.requests[p.written], conn.Conn(), address, conn.ID(), upstreamCfg.WriteTimeout, conn.Close); upstreamErr != nil {
+				return
+			}
+			p.written++
+			continue
+		}
+		if p.ended() {
+			break
+		}
+		if !c.requestBuffered() {
+			p.idle = true
+			break
+		}
+		if err = c.readPipelined(log, p); err != nil {
+			return
+		}
+	}
+	if wm := p.terminator(); wm != nil {
+		if upstreamErr = WriteWireMessage(c.ctx, log, wm, conn.Conn(), address, conn.ID(), upstreamCfg.WriteTimeout, conn.Close); upstreamErr != nil {
+			return
+		}
 	}
 
-	res, err = ReadWireMessage(c.ctx, log, wm, conn.Conn(), conn.Address().String(), conn.ID(), c.cfg.ReadTimeout, conn.Close)
-	return
+	// Responses aren't limited to the max item size of requests, since values may have been stored by other
+	// clients or with a larger item size configured upstream.
+	var res []byte
+	for {
+		if res, upstreamErr = ReadWireMessage(c.ctx, log, res, conn.Conn(), address, conn.ID(), upstreamCfg.ReadTimeout, protocol.MagicResponse, 0, conn.Close); upstreamErr != nil {
+			return
+		}
+		p.answer(res)
+		drained = finalResponse(header(res))
+		if drained && p.terminator() != nil {
+			return
+		}
+		if err = WriteWireMessage(c.ctx, log, res, c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+			return
+		}
+		p.responded = true
+		if drained {
+			return
+		}
+	}
 }
 
-func (c *connection) checkoutConnection() (conn pool.ConnectionWrapper, err error) {
+// readPipelined reads the request that follows the last quiet request of p from the client, which either
+// continues or terminates the pipeline
+func (c *connection) readPipelined(log *zap.Logger, p *binaryPipeline) error {
+	wm, err := ReadWireMessage(c.ctx, log, nil, c.conn, c.address, c.id, 0, protocol.MagicRequest, c.cfg.MaxItemSize, c.conn.Close)
+	if err != nil {
+		herr, ok := err.(*protocol.HeaderError)
+		if !ok || !herr.Recoverable {
+			return err
+		}
+		p.herr = herr
+		return nil
+	}
+	if header(wm).Opcode.Quit() {
+		p.quit = wm
+	} else if key := requestKey(wm); (key != nil && c.route(key) != p.server) || c.spansServers(wm) {
+		p.next = wm
+	} else {
+		p.requests = append(p.requests, wm)
+	}
+	return nil
+}
+
+// requestBuffered reports whether the client's next request has already been buffered in full, so that reading it
+// doesn't wait for the client
+func (c *connection) requestBuffered() bool {
+	buf, _ := c.conn.Peek(c.conn.Buffered())
+	return len(buf) >= protocol.HeaderLen && len(buf) >= protocol.HeaderLen+int(header(buf).BodyLength)
+}
+
+// endPipeline answers the request that terminated p, if any, after the responses to p, and returns the request
+// to forward next
+func (c *connection) endPipeline(p *binaryPipeline) ([]byte, error) {
+	switch {
+	case p.herr != nil:
+		return nil, c.respondHeaderError(p.herr)
+	case p.quit != nil:
+		return nil, c.quit(p.quit)
+	}
+	return p.next, nil
+}
+
+// failPipeline answers the requests of p that the server didn't answer, because they couldn't be forwarded or the
+// upstream failed with cause. Quiet updates that were written fail too, because their outcome is unknown. The rest
+// of the pipeline is read from the client and answered until it ends like in serverRoundTrip.
+func (c *connection) failPipeline(p *binaryPipeline, cause error) (next []byte, err error) {
+	for {
+		for _, wm := range p.requests[p.answered:] {
+			if res := c.failedResponse(wm, cause); res != nil {
+				if err = WriteWireMessage(c.ctx, c.log, res, c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+					return
+				}
+			}
+		}
+		p.answered = len(p.requests)
+		if p.ended() {
+			return c.endPipeline(p)
+		}
+		if err = c.readPipelined(c.log, p); err != nil {
+			return
+		}
+	}
+}
+
+// retry reports whether a request that was forwarded for the attempt'th time since start can be forwarded again
+// after failing with err. Only dead connections are retried, not timeouts, and only within the retry timeout.
+func (c *connection) retry(attempt int, start time.Time, err error) bool {
+	if attempt >= c.cfg.Retries || time.Since(start) >= c.cfg.RetryTimeout {
+		return false
+	}
+	if dl, ok := c.ctx.Deadline(); ok && time.Now().After(dl) {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	var connErr pool.ConnectionError
+	if !errors.As(err, &connErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
+
+// retried records the outcome of a retry on the upstream with address
+func (c *connection) retried(address string, success bool) {
+	_ = c.statsd.Incr("upstream_retry", append([]string{
+		fmt.Sprintf("address:%s", address),
+		fmt.Sprintf("success:%v", success),
+	}, c.cfg.StatsdTags...), 1)
+}
+
+// failedResponse returns the response to the request wm that couldn't be forwarded or answered because of cause,
+// or nil if the request isn't answered. Noops succeed, and retrievals miss if the circuit breaker is open and
+// BreakerMiss is set, so clients can carry on as if the keys weren't cached. Other requests fail with out of
+// memory if the pool is exhausted, and with a temporary failure otherwise.
+func (c *connection) failedResponse(wm []byte, cause error) []byte {
+	h := header(wm)
+	switch {
+	case h.Opcode == protocol.OpNoop:
+		return protocol.NewResponse(protocol.OpNoop, protocol.StatusNoError, h.Opaque, nil, nil, nil).Encode()
+	case c.cfg.BreakerMiss && cause == pool.ErrCircuitOpen && retrievalOpcodes[h.Opcode]:
+		if h.Opcode.Quiet() {
+			return nil
+		}
+		var key []byte
+		if h.Opcode == protocol.OpGetK || h.Opcode == protocol.OpGATK {
+			key = requestKey(wm)
+		}
+		return protocol.NewResponse(h.Opcode, protocol.StatusKeyNotFound, h.Opaque, nil, key, []byte("Not found")).Encode()
+	case cause == pool.ErrWaitQueueTimeout:
+		return protocol.NewErrorResponse(h, protocol.StatusOutOfMemory, "Out of memory").Encode()
+	}
+	return protocol.NewErrorResponse(h, protocol.StatusTemporaryFailure, "Temporary failure").Encode()
+}
+
+// upstreamFailed records that an upstream failed with err, after which the client gets error responses
+func (c *connection) upstreamFailed(log *zap.Logger, err error) {
+	log.Warn("Upstream failed", zap.Error(err))
+	_ = c.statsd.Incr("upstream_failure", c.cfg.StatsdTags, 1)
+}
+
+// respondHeaderError answers a request that had an invalid header with an error response if the client can recover
+// from it. Otherwise the client connection has already been closed, and the error is returned again.
+func (c *connection) respondHeaderError(herr *protocol.HeaderError) error {
+	c.log.Debug("Invalid header", zap.Error(herr))
+	if !herr.Recoverable {
+		return herr
+	}
+	return WriteWireMessage(c.ctx, c.log, protocol.NewErrorResponse(herr.Header, herr.Status, herr.Message).Encode(), c.conn, c.address, c.id, 0, c.conn.Close)
+}
+
+// quit responds to a quit request if it isn't quiet, and returns io.EOF so the client connection is closed
+func (c *connection) quit(wm []byte) error {
+	if header(wm).Opcode == protocol.OpQuit {
+		if err := WriteWireMessage(c.ctx, c.log, quitResponse(header(wm)), c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+func (c *connection) checkoutConnection(server *pool.Server) (conn pool.ConnectionWrapper, err error) {
 	defer func(start time.Time) {
 		addr := ""
 		if conn != nil {
 			addr = conn.Address().String()
 		}
-		_ = c.statsd.Timing("checkout_connection", time.Since(start), []string{
+		_ = c.statsd.Timing("checkout_connection", time.Since(start), append([]string{
 			fmt.Sprintf("address:%s", addr),
 			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		}, c.cfg.StatsdTags...), 1)
 	}(time.Now())
 
-	conn, err = c.server.Connection(c.ctx)
+	ctx, cancel := context.WithCancel(c.ctx)
+	if c.cfg.CheckoutTimeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, c.cfg.CheckoutTimeout)
+	}
+	defer cancel()
+
+	// The client is only watched while the checkout waits, since most checkouts get an idle connection right away.
+	var stop func()
+	conn, err = server.Connection(pool.WithWaitHook(ctx, func() {
+		if stop == nil {
+			stop = c.watchHangup()
+		}
+	}))
+	if stop != nil {
+		stop()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -131,6 +542,32 @@ func (c *connection) checkoutConnection() (conn pool.ConnectionWrapper, err erro
 	return conn, nil
 }
 
+// watchHangup cancels the connection context if the client connection fails before the returned stop function is
+// called, so that a checkout doesn't keep waiting for a client that is gone. A client that only closed its write
+// side, which reads as EOF, still gets the responses to the requests it sent, so EOF isn't a hangup. Requests
+// pipelined by the client in the meantime stay buffered.
+func (c *connection) watchHangup() (stop func()) {
+	if c.conn.Buffered() > 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var netErr net.Error
+		if _, err := c.conn.Peek(1); err != nil && err != io.EOF && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			c.log.Debug("Client hung up", zap.Error(err))
+			c.cancel()
+		}
+	}()
+	return func() {
+		// Unblock the Peek with a deadline in the past. Reads set their own deadlines afterwards.
+		_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
 func WriteWireMessage(ctx context.Context, log *zap.Logger, wm []byte, nc net.Conn, address string, id uint64, writeTimeout time.Duration, close func() error) error {
 	var err error
 	select {
@@ -167,7 +604,10 @@ func WriteWireMessage(ctx context.Context, log *zap.Logger, wm []byte, nc net.Co
 	return nil
 }
 
-func ReadWireMessage(ctx context.Context, log *zap.Logger, dst []byte, nc net.Conn, address string, id uint64, readTimeout time.Duration, close func() error) ([]byte, error) {
+// ReadWireMessage reads a binary protocol message from nc into dst. The header must have the given magic byte,
+// and a value no longer than maxValueLength if that is set. A protocol.HeaderError is returned for headers that fail
+// validation, and the connection is closed unless the message body could be skipped.
+func ReadWireMessage(ctx context.Context, log *zap.Logger, dst []byte, nc net.Conn, address string, id uint64, readTimeout time.Duration, magic byte, maxValueLength int, close func() error) ([]byte, error) {
 	select {
 	case <-ctx.Done():
 		// We closeConnection the connection because we don't know if there is an unread message on the wire.
@@ -191,11 +631,11 @@ func ReadWireMessage(ctx context.Context, log *zap.Logger, dst []byte, nc net.Co
 
 	// We use an array here because it only costs 24 bytes on the stack and means we'll only need to
 	// reslice dst once instead of twice.
-	var headerBuf [24]byte
+	var headerBuf [protocol.HeaderLen]byte
 
 	// We do a ReadFull into an array here instead of doing an opportunistic ReadAtLeast into dst
 	// because there might be more than one wire message waiting to be read, for example when
-	// reading messages from an exhaust cursor.
+	// reading quiet responses in a pipeline.
 	_, err := io.ReadFull(nc, headerBuf[:])
 	if err != nil {
 		// We closeConnection the connection because we don't know if there are other bytes left to read.
@@ -206,12 +646,28 @@ func ReadWireMessage(ctx context.Context, log *zap.Logger, dst []byte, nc net.Co
 		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "incomplete read of message header"}
 	}
 
-	// read the length as an int32
-	size := 24 + ((int32(headerBuf[11])) | (int32(headerBuf[10]) << 8) | (int32(headerBuf[9]) << 16) | (int32(headerBuf[8]) << 24))
+	h, _ := protocol.DecodeHeader(headerBuf[:])
+
+	log.Debug("Read header", zap.String("address", address), zap.Stringer("opcode", h.Opcode), zap.Uint32("size", h.BodyLength), zap.String("hex", hex.EncodeToString(headerBuf[:])))
 
-	log.Debug("Read header", zap.String("address", address), zap.Int("length", 24), zap.Int32("size", size-24), zap.String("hex", hex.EncodeToString(headerBuf[:])))
+	if h.Magic != magic {
+		// We close the connection because we can't find the start of the next message after a bad magic byte.
+		_ = close()
+		return nil, &protocol.HeaderError{Header: h, Status: protocol.StatusInvalidArguments, Message: "Invalid magic"}
+	}
+
+	if herr := h.Validate(maxValueLength); herr != nil {
+		// Skip the body, like memcached does, so that the connection can be used for the next message.
+		if _, err = io.CopyN(ioutil.Discard, nc, int64(h.BodyLength)); err != nil {
+			_ = close()
+			return nil, herr
+		}
+		herr.Recoverable = true
+		return nil, herr
+	}
 
-	if int(size) > cap(dst) {
+	size := protocol.HeaderLen + int(h.BodyLength)
+	if size > cap(dst) {
 		// Since we can't grow this slice without allocating, just allocate an entirely new slice.
 		dst = make([]byte, 0, size)
 	}
@@ -220,19 +676,19 @@ func ReadWireMessage(ctx context.Context, log *zap.Logger, dst []byte, nc net.Co
 	dst = dst[:size]
 	copy(dst, headerBuf[:])
 
-	if size > 24 {
-		_, err = io.ReadFull(nc, dst[24:])
+	if size > protocol.HeaderLen {
+		_, err = io.ReadFull(nc, dst[protocol.HeaderLen:])
 		if err != nil {
 			// We closeConnection the connection because we don't know if there are other bytes left to read.
 			_ = close()
 			return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "incomplete read of full message"}
 		}
 
-		max := int32(64)
+		max := 64
 		if size < max {
 			max = size
 		}
-		log.Debug("Read", zap.String("address", address), zap.Int32("length", size-24), zap.String("hex", hex.EncodeToString(dst[24:max])))
+		log.Debug("Read", zap.String("address", address), zap.Int("length", size-protocol.HeaderLen), zap.String("hex", hex.EncodeToString(dst[protocol.HeaderLen:max])))
 	}
 
 	return dst, nil
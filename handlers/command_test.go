@@ -0,0 +1,712 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/config"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// fakeMemcached is a minimal in-memory binary protocol memcached server
+type fakeMemcached struct {
+	items map[string][]byte
+	conns map[net.Conn]bool
+	sync.Mutex
+}
+
+// hangup closes the open connections, like memcached does when they have been idle for too long
+func (f *fakeMemcached) hangup() {
+	f.Lock()
+	defer f.Unlock()
+	for nc := range f.conns {
+		_ = nc.Close()
+	}
+}
+
+// deadKey makes fakeMemcached hang up without responding when it is requested
+const deadKey = "dead"
+
+func (f *fakeMemcached) get(key string) []byte {
+	f.Lock()
+	defer f.Unlock()
+	return f.items[key]
+}
+
+func (f *fakeMemcached) serve(nc net.Conn) {
+	f.Lock()
+	if f.conns == nil {
+		f.conns = map[net.Conn]bool{}
+	}
+	f.conns[nc] = true
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		delete(f.conns, nc)
+		f.Unlock()
+		_ = nc.Close()
+	}()
+	conn := newBufferedConn(nc)
+	if magic, err := conn.Peek(1); err != nil || magic[0] != protocol.MagicRequest {
+		f.serveText(conn)
+		return
+	}
+	for {
+		wm, err := ReadWireMessage(context.Background(), zap.NewNop(), nil, conn, "fake", 0, 0, protocol.MagicRequest, 0, conn.Close)
+		if err != nil {
+			return
+		}
+		req, err := protocol.DecodeRequest(wm)
+		if err != nil || string(req.Key) == deadKey {
+			return
+		}
+
+		var res []byte
+		respond := func(status protocol.Status, key, value []byte) {
+			res = append(res, protocol.NewResponse(req.Opcode, status, req.Opaque, nil, key, value).Encode()...)
+		}
+		f.Lock()
+		switch req.Opcode {
+		case protocol.OpGet, protocol.OpGetQ, protocol.OpGetK, protocol.OpGetKQ:
+			value, ok := f.items[string(req.Key)]
+			switch {
+			case !ok && !req.Opcode.Quiet():
+				respond(protocol.StatusKeyNotFound, nil, nil)
+			case ok && (req.Opcode == protocol.OpGetK || req.Opcode == protocol.OpGetKQ):
+				respond(protocol.StatusNoError, req.Key, value)
+			case ok:
+				respond(protocol.StatusNoError, nil, value)
+			}
+		case protocol.OpSet, protocol.OpSetQ:
+			f.items[string(req.Key)] = append([]byte(nil), req.Value...)
+			if !req.Opcode.Quiet() {
+				respond(protocol.StatusNoError, nil, nil)
+			}
+		case protocol.OpFlush, protocol.OpFlushQ:
+			f.items = map[string][]byte{}
+			if !req.Opcode.Quiet() {
+				respond(protocol.StatusNoError, nil, nil)
+			}
+		case protocol.OpStat:
+			respond(protocol.StatusNoError, []byte("pid"), []byte("1"))
+			respond(protocol.StatusNoError, []byte("uptime"), []byte("1"))
+			respond(protocol.StatusNoError, nil, nil)
+		default:
+			respond(protocol.StatusNoError, nil, nil)
+		}
+		f.Unlock()
+		if _, err := conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+func request(op protocol.Opcode, opaque uint32, key string, value ...byte) []byte {
+	return protocol.NewRequest(op, opaque, nil, []byte(key), value).Encode()
+}
+
+// startServer runs a fake memcached, returning a server with opts connected to it
+func startServer(t *testing.T, f *fakeMemcached, opts ...pool.ServerOption) *pool.Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	server, err := pool.ConnectServer(pool.Address(l.Addr().String()), opts...)
+	assert.NoError(t, err)
+	return server
+}
+
+// startProxy runs a CommandConnection backed by a fake memcached, returning the client end
+func startProxy(t *testing.T, f *fakeMemcached) net.Conn {
+	return startRoutedProxy(t, SingleServer(startServer(t, f)))
+}
+
+// startRoutedProxy runs a CommandConnection that routes requests with route, returning the client end
+func startRoutedProxy(t *testing.T, route Router) net.Conn {
+	return startConfiguredProxy(t, route, &config.Config{ReadTimeout: time.Second, WriteTimeout: time.Second, MaxItemSize: 16})
+}
+
+// startConfiguredProxy runs a CommandConnection with cfg that routes requests with route, returning the client end
+func startConfiguredProxy(t *testing.T, route Router, cfg *config.Config) net.Conn {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+
+	client, proxy := net.Pipe()
+	go CommandConnection(zap.NewNop(), sd, config.NewReloadable(cfg), proxy, "local", 1, "", route, func() []*pool.Server { return []*pool.Server{route(nil)} }, make(chan interface{}))
+	return client
+}
+
+// startTCPProxy runs a CommandConnection like startConfiguredProxy, but over TCP, so the client can close its write
+// side or reset the connection
+func startTCPProxy(t *testing.T, route Router, cfg *config.Config) *net.TCPConn {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	proxy, err := l.Accept()
+	assert.NoError(t, err)
+	go func() {
+		CommandConnection(zap.NewNop(), sd, config.NewReloadable(cfg), proxy, "local", 1, "", route, func() []*pool.Server { return []*pool.Server{route(nil)} }, make(chan interface{}))
+		_ = proxy.Close()
+	}()
+	return client.(*net.TCPConn)
+}
+
+// startOpenServer returns a server for an address that refuses connections, with a circuit breaker that has
+// been opened
+func startOpenServer(t *testing.T) *pool.Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = l.Close()
+
+	server, err := pool.ConnectServer(pool.Address(l.Addr().String()), pool.WithCircuitBreaker(func(pool.BreakerConfig) pool.BreakerConfig {
+		return pool.BreakerConfig{Failures: 1, OpenTimeout: time.Minute}
+	}))
+	assert.NoError(t, err)
+	_, err = server.Connection(context.Background())
+	assert.Error(t, err)
+	_, err = server.Connection(context.Background())
+	assert.Equal(t, pool.ErrCircuitOpen, err)
+	return server
+}
+
+// prefixRouter routes keys starting with b to the second server, and everything else to the first
+func prefixRouter(t *testing.T, a, b *fakeMemcached) Router {
+	servers := []*pool.Server{startServer(t, a), startServer(t, b)}
+	return func(key []byte) *pool.Server {
+		if len(key) > 0 && key[0] == 'b' {
+			return servers[1]
+		}
+		return servers[0]
+	}
+}
+
+// startSpanningProxy runs a CommandConnection that routes requests like prefixRouter, and forwards requests that
+// concern every server to both a and b
+func startSpanningProxy(t *testing.T, a, b *fakeMemcached) net.Conn {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+
+	servers := []*pool.Server{startServer(t, a), startServer(t, b)}
+	route := func(key []byte) *pool.Server {
+		if len(key) > 0 && key[0] == 'b' {
+			return servers[1]
+		}
+		return servers[0]
+	}
+	cfg := &config.Config{ReadTimeout: time.Second, WriteTimeout: time.Second, MaxItemSize: 16}
+	client, proxy := net.Pipe()
+	go CommandConnection(zap.NewNop(), sd, config.NewReloadable(cfg), proxy, "local", 1, "", route, func() []*pool.Server { return servers }, make(chan interface{}))
+	return client
+}
+
+// openRouter routes keys starting with b to open, and everything else to a new server for f
+func openRouter(t *testing.T, f *fakeMemcached, open *pool.Server) Router {
+	server := startServer(t, f)
+	return func(key []byte) *pool.Server {
+		if len(key) > 0 && key[0] == 'b' {
+			return open
+		}
+		return server
+	}
+}
+
+func readResponse(t *testing.T, conn net.Conn) *protocol.Response {
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	wm, err := ReadWireMessage(context.Background(), zap.NewNop(), nil, conn, "client", 0, 0, protocol.MagicResponse, 0, conn.Close)
+	assert.NoError(t, err)
+	res, err := protocol.DecodeResponse(wm)
+	assert.NoError(t, err)
+	return res
+}
+
+func TestQuietPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'x')...)
+	pipeline = append(pipeline, request(protocol.OpSetQ, 2, "b", 'y')...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 3, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpNoop, res.Opcode)
+	assert.Equal(t, uint32(3), res.Opaque)
+	assert.Equal(t, []byte("x"), f.get("a"))
+	assert.Equal(t, []byte("y"), f.get("b"))
+
+	pipeline = nil
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 4, "a")...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 5, "missing")...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 6, "b")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 7, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpGetKQ, res.Opcode)
+	assert.Equal(t, "a", string(res.Key))
+	assert.Equal(t, "x", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpGetKQ, res.Opcode)
+	assert.Equal(t, "b", string(res.Key))
+	assert.Equal(t, "y", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpNoop, res.Opcode)
+	assert.Equal(t, uint32(7), res.Opaque)
+}
+
+func TestIdleQuietPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	server := startServer(t, f)
+	conn := startRoutedProxy(t, SingleServer(server))
+	defer conn.Close()
+
+	// a quiet request that isn't followed by another one doesn't keep the upstream connection checked out
+	go func() {
+		_, _ = conn.Write(request(protocol.OpSetQ, 1, "a", 'x'))
+	}()
+	assert.Eventually(t, func() bool {
+		return f.get("a") != nil && server.Stats().CheckedOut == 0
+	}, time.Second, time.Millisecond)
+
+	go func() {
+		_, _ = conn.Write(request(protocol.OpGet, 2, "a"))
+	}()
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpGet, res.Opcode)
+	assert.Equal(t, uint32(2), res.Opaque)
+	assert.Equal(t, "x", string(res.Value))
+}
+
+func TestLargeResponse(t *testing.T) {
+	// values stored by other clients, or by memcached configured with a larger item size, aren't limited by the
+	// max item size of requests
+	value := bytes.Repeat([]byte("x"), 32)
+	conn := startProxy(t, &fakeMemcached{items: map[string][]byte{"a": value}})
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write(request(protocol.OpGet, 1, "a"))
+	}()
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.StatusNoError, res.Status)
+	assert.Equal(t, value, res.Value)
+}
+
+func TestStatResponses(t *testing.T) {
+	conn := startProxy(t, &fakeMemcached{items: map[string][]byte{}})
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write(request(protocol.OpStat, 1, ""))
+	}()
+
+	assert.Equal(t, "pid", string(readResponse(t, conn).Key))
+	assert.Equal(t, "uptime", string(readResponse(t, conn).Key))
+	assert.Empty(t, readResponse(t, conn).Key)
+}
+
+func TestQuitAfterPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'x')...)
+	pipeline = append(pipeline, request(protocol.OpQuit, 2, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpQuit, res.Opcode)
+	assert.Equal(t, uint32(2), res.Opaque)
+	assert.Equal(t, []byte("x"), f.get("a"))
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+
+	tooLarge := request(protocol.OpSet, 1, "a", make([]byte, 17)...)
+	badKey := request(protocol.OpGet, 2, "a")
+	badKey[3] = 2 // key length longer than the body
+	var pipeline []byte
+	pipeline = append(pipeline, tooLarge...)
+	pipeline = append(pipeline, badKey...)
+	pipeline = append(pipeline, request(protocol.OpSetQ, 3, "b", 'y')...)
+	pipeline = append(pipeline, tooLarge...)
+	pipeline = append(pipeline, request(protocol.OpGet, 4, "b")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpSet, res.Opcode)
+	assert.Equal(t, protocol.StatusValueTooLarge, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusInvalidArguments, res.Status)
+	assert.Equal(t, uint32(2), res.Opaque)
+
+	// an invalid request ends a quiet pipeline
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusValueTooLarge, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpGet, res.Opcode)
+	assert.Equal(t, "y", string(res.Value))
+}
+
+func TestInvalidMagicInPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+
+	badMagic := request(protocol.OpGet, 2, "a")
+	badMagic[0] = protocol.MagicResponse
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'x')...)
+	pipeline = append(pipeline, badMagic...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	// the start of the next request can't be found, so the connection is closed without a response
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRoutedPipeline(t *testing.T) {
+	a := &fakeMemcached{items: map[string][]byte{}}
+	b := &fakeMemcached{items: map[string][]byte{"b": []byte("y")}}
+	conn := startRoutedProxy(t, prefixRouter(t, a, b))
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'x')...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 2, "b")...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 3, "a")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 4, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, "b", string(res.Key))
+	assert.Equal(t, "y", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, "a", string(res.Key))
+	assert.Equal(t, "x", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpNoop, res.Opcode)
+	assert.Equal(t, uint32(4), res.Opaque)
+	assert.Equal(t, []byte("x"), a.get("a"))
+	assert.Nil(t, b.get("a"))
+}
+
+func TestBroadcast(t *testing.T) {
+	a := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	b := &fakeMemcached{items: map[string][]byte{"b": []byte("y")}}
+	conn := startSpanningProxy(t, a, b)
+	defer conn.Close()
+
+	// flushes go to every server, also in the middle of a pipeline
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'z')...)
+	pipeline = append(pipeline, request(protocol.OpFlush, 2, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpFlush, res.Opcode)
+	assert.Equal(t, protocol.StatusNoError, res.Status)
+	assert.Equal(t, uint32(2), res.Opaque)
+	assert.Nil(t, a.get("a"))
+	assert.Nil(t, b.get("b"))
+
+	// quiet flushes are only answered with errors
+	pipeline = append(request(protocol.OpFlushQ, 3, ""), request(protocol.OpNoop, 4, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpNoop, res.Opcode)
+	assert.Equal(t, uint32(4), res.Opaque)
+
+	// the stats of several servers can't be told apart
+	go func() {
+		_, _ = conn.Write(request(protocol.OpStat, 5, ""))
+	}()
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusNotSupported, res.Status)
+	assert.Equal(t, uint32(5), res.Opaque)
+}
+
+func TestCircuitOpen(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	open := startOpenServer(t)
+	conn := startRoutedProxy(t, openRouter(t, f, open))
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 1, "b")...)
+	pipeline = append(pipeline, request(protocol.OpSetQ, 2, "b", 'y')...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 3, "a")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 4, "")...)
+	pipeline = append(pipeline, request(protocol.OpGet, 5, "b")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+	assert.Equal(t, uint32(2), res.Opaque)
+	res = readResponse(t, conn)
+	assert.Equal(t, "x", string(res.Value))
+	assert.Equal(t, protocol.OpNoop, readResponse(t, conn).Opcode)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpGet, res.Opcode)
+	assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+	assert.Equal(t, uint32(5), res.Opaque)
+
+	// retrievals miss with BreakerMiss
+	conn = startConfiguredProxy(t, openRouter(t, f, open), &config.Config{BreakerMiss: true})
+	defer conn.Close()
+	pipeline = nil
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 1, "b")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 2, "")...)
+	pipeline = append(pipeline, request(protocol.OpGetK, 3, "b")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+	assert.Equal(t, protocol.OpNoop, readResponse(t, conn).Opcode)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusKeyNotFound, res.Status)
+	assert.Equal(t, "b", string(res.Key))
+
+	// text requests, on new upstream connections because the fake only serves one protocol per connection
+	conn = startConfiguredProxy(t, openRouter(t, f, open), &config.Config{BreakerMiss: true})
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	go func() {
+		_, _ = conn.Write([]byte("get a b\r\nset b 0 0 1\r\ny\r\n"))
+	}()
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+	assert.Equal(t, "SERVER_ERROR temporary failure\r\n", roundTripText(t, r, 1))
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpSetQ, 1, "a", 'x')...)
+	pipeline = append(pipeline, request(protocol.OpSetQ, 2, deadKey, 'y')...)
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 3, "a")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 4, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	// the outcome of the quiet requests is unknown, so they all fail
+	for opaque := uint32(1); opaque <= 3; opaque++ {
+		res := readResponse(t, conn)
+		assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+		assert.Equal(t, opaque, res.Opaque)
+	}
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpNoop, res.Opcode)
+	assert.Equal(t, uint32(4), res.Opaque)
+
+	// the client connection is still usable
+	go func() {
+		_, _ = conn.Write(request(protocol.OpGet, 5, "a"))
+	}()
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusNoError, res.Status)
+	assert.Equal(t, "x", string(res.Value))
+}
+
+func TestPipelineAnswer(t *testing.T) {
+	response := func(opcode protocol.Opcode, key string) []byte {
+		return protocol.NewResponse(opcode, protocol.StatusNoError, 0, nil, []byte(key), nil).Encode()
+	}
+
+	// every request has opaque 0, like Dalli sends them
+	p := &binaryPipeline{requests: [][]byte{
+		request(protocol.OpGetKQ, 0, "a"),
+		request(protocol.OpGetKQ, 0, "b"),
+		request(protocol.OpSetQ, 0, "c", 'x'),
+		request(protocol.OpGet, 0, "d"),
+		request(protocol.OpGetKQ, 0, "e"),
+	}}
+	p.written = len(p.requests)
+	p.answer(response(protocol.OpGetKQ, "b"))
+	assert.Equal(t, 2, p.answered)
+
+	// a quiet response doesn't pass a request that isn't quiet
+	p.answer(response(protocol.OpGetKQ, "e"))
+	assert.Equal(t, 2, p.answered)
+	p.answer(response(protocol.OpGet, ""))
+	assert.Equal(t, 4, p.answered)
+	p.answer(response(protocol.OpGetKQ, "e"))
+	assert.Equal(t, 5, p.answered)
+
+	// the terminating noop answers the rest
+	p = &binaryPipeline{requests: [][]byte{request(protocol.OpGetKQ, 0, "a"), request(protocol.OpGetKQ, 0, "b")}}
+	p.written = len(p.requests)
+	p.answer(response(protocol.OpNoop, ""))
+	assert.Equal(t, 2, p.answered)
+}
+
+func TestFailedResponse(t *testing.T) {
+	c := &connection{cfg: &config.Config{}}
+	res, err := protocol.DecodeResponse(c.failedResponse(request(protocol.OpSet, 1, "a", 'x'), pool.ErrWaitQueueTimeout))
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.StatusOutOfMemory, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+
+	// retrievals only miss while the breaker is open
+	c.cfg.BreakerMiss = true
+	res, err = protocol.DecodeResponse(c.failedResponse(request(protocol.OpGet, 2, "a"), pool.ErrServerClosed))
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+	assert.Nil(t, c.failedResponse(request(protocol.OpGetQ, 3, "a"), pool.ErrCircuitOpen))
+}
+
+func TestRetry(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startConfiguredProxy(t, SingleServer(startServer(t, f)), &config.Config{ReadTimeout: time.Second, WriteTimeout: time.Second, Retries: 1, RetryTimeout: time.Second})
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write(request(protocol.OpSet, 1, "a", 'x'))
+	}()
+	assert.Equal(t, protocol.StatusNoError, readResponse(t, conn).Status)
+
+	// reads go out again on a new connection
+	f.hangup()
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpGetKQ, 2, "a")...)
+	pipeline = append(pipeline, request(protocol.OpNoop, 3, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+	res := readResponse(t, conn)
+	assert.Equal(t, uint32(2), res.Opaque)
+	assert.Equal(t, "x", string(res.Value))
+	assert.Equal(t, protocol.OpNoop, readResponse(t, conn).Opcode)
+
+	// writes that reached the server aren't retried
+	f.hangup()
+	go func() {
+		_, _ = conn.Write(request(protocol.OpSet, 4, "a", 'y'))
+	}()
+	res = readResponse(t, conn)
+	assert.Equal(t, uint32(4), res.Opaque)
+	assert.Equal(t, protocol.StatusTemporaryFailure, res.Status)
+}
+
+func TestCheckoutTimeout(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	checkouts := make(chan string, 10)
+	server := startServer(t, f,
+		pool.WithMaxConnections(func(uint64) uint64 { return 1 }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor {
+			return &pool.Monitor{Event: func(e *pool.Event) {
+				if e.Type == pool.GetFailed {
+					checkouts <- e.Reason
+				}
+			}}
+		}),
+	)
+	conn := startConfiguredProxy(t, SingleServer(server), &config.Config{CheckoutTimeout: 50 * time.Millisecond})
+	defer conn.Close()
+
+	// the only connection is checked out, so the pool is exhausted
+	held, err := server.Connection(context.Background())
+	assert.NoError(t, err)
+	defer held.Close()
+
+	go func() {
+		_, _ = conn.Write(request(protocol.OpGet, 1, "a"))
+	}()
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.StatusOutOfMemory, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+	assert.Equal(t, pool.ReasonTimedOut, <-checkouts)
+
+	// a client whose connection is reset leaves the wait queue without waiting for the timeout
+	tcp := startTCPProxy(t, SingleServer(server), &config.Config{})
+	_, err = tcp.Write(request(protocol.OpGet, 2, "a"))
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, tcp.SetLinger(0))
+	assert.NoError(t, tcp.Close())
+	select {
+	case reason := <-checkouts:
+		assert.Equal(t, pool.ReasonTimedOut, reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "checkout still waiting")
+	}
+}
+
+func TestCheckoutAfterHalfClose(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	server := startServer(t, f, pool.WithMaxConnections(func(uint64) uint64 { return 1 }))
+	held, err := server.Connection(context.Background())
+	assert.NoError(t, err)
+
+	// a client that closed its write side after its request still gets the response once a connection is free
+	tcp := startTCPProxy(t, SingleServer(server), &config.Config{ReadTimeout: time.Second, WriteTimeout: time.Second})
+	defer tcp.Close()
+	_, err = tcp.Write(request(protocol.OpGet, 1, "a"))
+	assert.NoError(t, err)
+	assert.NoError(t, tcp.CloseWrite())
+	time.Sleep(10 * time.Millisecond)
+	_ = held.Return()
+
+	res := readResponse(t, tcp)
+	assert.Equal(t, protocol.StatusNoError, res.Status)
+	assert.Equal(t, "x", string(res.Value))
+}
@@ -1,18 +1,79 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"go.uber.org/zap"
 	"io"
 	"net"
-	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/protocol"
 )
 
-func ConfigConnection(log *zap.Logger, conn net.Conn, kill chan interface{}, configsJoined string) {
-	var buf []byte
-	tmp := make([]byte, 4096)
+// configVersion is the memcached version reported by the config endpoint. ElastiCache clients use config get
+// cluster instead of the legacy get AmazonElastiCache:cluster for versions from 1.4.14.
+const configVersion = "1.6.0"
+
+// legacyConfigKey is the key that clients of memcached versions before 1.4.14 get the cluster config from
+const legacyConfigKey = "AmazonElastiCache:cluster"
+
+// ClusterConfig is the cluster config advertised by the local config endpoint. Its version starts at 1 and is
+// incremented whenever the advertised nodes change, so clients know to remap.
+type ClusterConfig struct {
+	mu      sync.RWMutex
+	version int
+	nodes   string
+}
+
+// Set advertises nodes, which is the nodes line of a config get cluster response
+func (c *ClusterConfig) Set(nodes string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version == 0 || nodes != c.nodes {
+		c.version++
+		c.nodes = nodes
+	}
+}
+
+// Get returns the version and nodes line of the advertised config
+func (c *ClusterConfig) Get() (int, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version, c.nodes
+}
+
+// data returns the data block of config responses
+func (c *ClusterConfig) data() []byte {
+	version, nodes := c.Get()
+	return []byte(fmt.Sprintf("%d\n%s\n", version, nodes))
+}
+
+// configKey is the key of binary config get requests for the cluster config
+const configKey = "cluster"
+
+// maxConfigValueLength bounds the values of binary requests to the config endpoint, which only need keys, so that
+// clients can't make it allocate large bodies
+const maxConfigValueLength = protocol.MaxKeyLength
+
+// ConfigConnection answers ElastiCache auto discovery requests on conn with the config of cluster. Requests can
+// use either the text or the binary protocol.
+func ConfigConnection(log *zap.Logger, conn net.Conn, kill chan interface{}, cluster *ClusterConfig) {
+	c := newBufferedConn(conn)
+	address := conn.LocalAddr().String()
 	for {
-		n, err := conn.Read(tmp)
+		var err error
+		var magic []byte
+		if magic, err = c.Peek(1); err == nil {
+			if magic[0] == protocol.MagicRequest {
+				err = handleBinaryConfigMessage(log, c, address, cluster)
+			} else {
+				err = handleConfigMessage(log, c, address, cluster)
+			}
+		}
 		if err != nil {
 			if err != io.EOF {
 				select {
@@ -24,27 +85,90 @@ func ConfigConnection(log *zap.Logger, conn net.Conn, kill chan interface{}, con
 			}
 			return
 		}
-		buf = append(buf, tmp[:n]...)
+	}
+}
 
-		for {
-			i := strings.Index(string(buf), "\r\n")
-			if i < 0 {
-				break
-			}
-			command := buf[:i]
-			buf = buf[i+2:]
-			if string(command) == "stats" {
-				_, err = conn.Write([]byte("STAT version 1.6.0\nEND\n"))
-				if err != nil {
-					panic(err)
-				}
-			} else if string(command) == "config get cluster" {
-				out := fmt.Sprintf("CONFIG cluster 0 %d\n1\n%s\n\nEND\n", len(configsJoined), configsJoined)
-				_, err = conn.Write([]byte(out))
-				if err != nil {
-					panic(err)
-				}
-			}
+// handleConfigMessage reads a text protocol request from the client and answers it, returning io.EOF when the
+// connection should be closed
+func handleConfigMessage(log *zap.Logger, c *bufferedConn, address string, cluster *ClusterConfig) error {
+	ctx := context.Background()
+	line, err := readTextLine(ctx, log, c, address, 0, 0, c.Close)
+	if err != nil {
+		return err
+	}
+
+	var res []byte
+	fields := bytes.Fields(line)
+	command := ""
+	if len(fields) > 0 {
+		command = string(fields[0])
+	}
+	switch {
+	case command == "config" && len(fields) == 3 && string(fields[1]) == "get" && string(fields[2]) == "cluster":
+		data := cluster.data()
+		res = []byte(fmt.Sprintf("CONFIG cluster 0 %d\r\n%s\r\nEND\r\n", len(data), data))
+	case command == "get" && len(fields) == 2 && string(fields[1]) == legacyConfigKey:
+		data := cluster.data()
+		res = []byte(fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", legacyConfigKey, len(data), data))
+	case command == "version" && len(fields) == 1:
+		res = []byte("VERSION " + configVersion + "\r\n")
+	case command == "stats" && len(fields) == 1:
+		res = []byte("STAT version " + configVersion + "\r\nEND\r\n")
+	case command == "quit":
+		return io.EOF
+	default:
+		res = []byte("ERROR\r\n")
+	}
+
+	return WriteWireMessage(ctx, log, res, c, address, 0, 0, c.Close)
+}
+
+// handleBinaryConfigMessage reads a binary protocol request from the client and answers it, returning io.EOF when
+// the connection should be closed
+func handleBinaryConfigMessage(log *zap.Logger, c *bufferedConn, address string, cluster *ClusterConfig) error {
+	ctx := context.Background()
+	wm, err := ReadWireMessage(ctx, log, nil, c, address, 0, 0, protocol.MagicRequest, maxConfigValueLength, c.Close)
+	if err != nil {
+		// Only answer header errors the client can recover from, since the connection is already closed otherwise.
+		herr, ok := err.(*protocol.HeaderError)
+		if !ok || !herr.Recoverable {
+			return err
+		}
+		if herr.Status == protocol.StatusValueTooLarge {
+			herr.Status, herr.Message = protocol.StatusInvalidArguments, "Invalid arguments"
+		}
+		return WriteWireMessage(ctx, log, protocol.NewErrorResponse(herr.Header, herr.Status, herr.Message).Encode(), c, address, 0, 0, c.Close)
+	}
+	h := header(wm)
+
+	var res []byte
+	respond := func(status protocol.Status, key, value []byte) {
+		res = append(res, protocol.NewResponse(h.Opcode, status, h.Opaque, nil, key, value).Encode()...)
+	}
+	switch h.Opcode {
+	case protocol.OpConfigGet:
+		if string(requestKey(wm)) == configKey {
+			respond(protocol.StatusNoError, nil, cluster.data())
+		} else {
+			res = protocol.NewErrorResponse(h, protocol.StatusKeyNotFound, "Not found").Encode()
 		}
+	case protocol.OpVersion:
+		respond(protocol.StatusNoError, nil, []byte(configVersion))
+	case protocol.OpStat:
+		respond(protocol.StatusNoError, []byte("version"), []byte(configVersion))
+		respond(protocol.StatusNoError, nil, nil)
+	case protocol.OpNoop:
+		respond(protocol.StatusNoError, nil, nil)
+	case protocol.OpQuit:
+		if err := WriteWireMessage(ctx, log, quitResponse(h), c, address, 0, 0, c.Close); err != nil {
+			return err
+		}
+		return io.EOF
+	case protocol.OpQuitQ:
+		return io.EOF
+	default:
+		res = protocol.NewErrorResponse(h, protocol.StatusUnknownCommand, "Unknown command").Encode()
 	}
+
+	return WriteWireMessage(ctx, log, res, c, address, 0, 0, c.Close)
 }
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// startConfig runs a ConfigConnection for cluster, returning the client end
+func startConfig(t *testing.T, cluster *ClusterConfig) (net.Conn, *bufio.Reader) {
+	client, proxy := net.Pipe()
+	go func() {
+		ConfigConnection(zap.NewNop(), proxy, make(chan interface{}), cluster)
+		_ = proxy.Close()
+	}()
+	assert.NoError(t, client.SetDeadline(time.Now().Add(time.Second)))
+	return client, bufio.NewReader(client)
+}
+
+func TestClusterConfigVersion(t *testing.T) {
+	var cluster ClusterConfig
+	cluster.Set("a||")
+	version, nodes := cluster.Get()
+	assert.Equal(t, 1, version)
+	assert.Equal(t, "a||", nodes)
+
+	cluster.Set("a||")
+	version, _ = cluster.Get()
+	assert.Equal(t, 1, version)
+
+	cluster.Set("a|| b||")
+	version, nodes = cluster.Get()
+	assert.Equal(t, 2, version)
+	assert.Equal(t, "a|| b||", nodes)
+}
+
+func TestConfigConnection(t *testing.T) {
+	var cluster ClusterConfig
+	cluster.Set("localhost|127.0.0.1|11220")
+	conn, r := startConfig(t, &cluster)
+	defer conn.Close()
+
+	go func() {
+		_, _ = conn.Write([]byte("config get cluster\r\nversion\r\nstats\r\nbogus\r\nget AmazonElastiCache:cluster\r\n"))
+	}()
+	assert.Equal(t, "CONFIG cluster 0 28\r\n1\nlocalhost|127.0.0.1|11220\n\r\nEND\r\n", roundTripText(t, r, 5))
+	assert.Equal(t, "VERSION 1.6.0\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "STAT version 1.6.0\r\nEND\r\n", roundTripText(t, r, 2))
+	assert.Equal(t, "ERROR\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "VALUE AmazonElastiCache:cluster 0 28\r\n1\nlocalhost|127.0.0.1|11220\n\r\nEND\r\n", roundTripText(t, r, 5))
+
+	cluster.Set("localhost|127.0.0.1|11221")
+	go func() {
+		_, _ = conn.Write([]byte("config get cluster\r\nquit\r\n"))
+	}()
+	assert.Equal(t, "CONFIG cluster 0 28\r\n2\nlocalhost|127.0.0.1|11221\n\r\nEND\r\n", roundTripText(t, r, 5))
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBinaryConfigConnection(t *testing.T) {
+	var cluster ClusterConfig
+	cluster.Set("localhost|127.0.0.1|11220")
+	conn, _ := startConfig(t, &cluster)
+	defer conn.Close()
+
+	var pipeline []byte
+	pipeline = append(pipeline, request(protocol.OpConfigGet, 1, "cluster")...)
+	pipeline = append(pipeline, request(protocol.OpConfigGet, 2, "other")...)
+	pipeline = append(pipeline, request(protocol.OpVersion, 3, "")...)
+	pipeline = append(pipeline, request(protocol.OpAdd, 4, "a")...)
+	pipeline = append(pipeline, request(protocol.OpConfigGet, 5, "cluster", make([]byte, maxConfigValueLength+1)...)...)
+	pipeline = append(pipeline, request(protocol.OpQuit, 6, "")...)
+	go func() {
+		_, _ = conn.Write(pipeline)
+	}()
+
+	res := readResponse(t, conn)
+	assert.Equal(t, protocol.OpConfigGet, res.Opcode)
+	assert.Equal(t, protocol.StatusNoError, res.Status)
+	assert.Equal(t, uint32(1), res.Opaque)
+	assert.Equal(t, "1\nlocalhost|127.0.0.1|11220\n", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusKeyNotFound, res.Status)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpVersion, res.Opcode)
+	assert.Equal(t, "1.6.0", string(res.Value))
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusUnknownCommand, res.Status)
+	assert.Equal(t, uint32(4), res.Opaque)
+	// requests with large bodies are rejected after skipping them
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.StatusInvalidArguments, res.Status)
+	assert.Equal(t, uint32(5), res.Opaque)
+	res = readResponse(t, conn)
+	assert.Equal(t, protocol.OpQuit, res.Opcode)
+	assert.Equal(t, uint32(6), res.Opaque)
+
+	// text and binary requests can be mixed on a connection
+	conn, r := startConfig(t, &cluster)
+	defer conn.Close()
+	go func() {
+		_, _ = conn.Write(append(request(protocol.OpNoop, 1, ""), "version\r\n"...))
+	}()
+	assert.Equal(t, protocol.OpNoop, readResponse(t, conn).Opcode)
+	assert.Equal(t, "VERSION 1.6.0\r\n", roundTripText(t, r, 1))
+}
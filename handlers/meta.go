@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/base64"
+)
+
+// meta protocol commands, see https://github.com/memcached/memcached/wiki/MetaCommands
+var metaCommands = map[string]bool{
+	"mg": true,
+	"ms": true,
+	"md": true,
+	"ma": true,
+	"mn": true,
+	"me": true,
+}
+
+// noopMetaRequest is appended to meta pipelines that aren't already terminated by mn
+var noopMetaRequest = []byte("mn\r\n")
+
+// metaFlags returns the flags of a meta command line. Flags follow the key, and the data length for ms.
+func metaFlags(fields [][]byte) [][]byte {
+	skip := 2
+	switch string(fields[0]) {
+	case "mn":
+		skip = 1
+	case "ms":
+		skip = 3
+	}
+	if len(fields) < skip {
+		return nil
+	}
+	return fields[skip:]
+}
+
+// metaQuiet returns true if the meta command line has the q flag, meaning that only hits and errors are
+// responded to.
+func metaQuiet(fields [][]byte) bool {
+	for _, flag := range metaFlags(fields) {
+		if string(flag) == "q" {
+			return true
+		}
+	}
+	return false
+}
+
+// metaKey returns the key of a meta command line, decoding it if the command line has the b flag
+func metaKey(fields [][]byte) []byte {
+	for _, flag := range metaFlags(fields) {
+		if string(flag) == "b" {
+			key := make([]byte, base64.StdEncoding.DecodedLen(len(fields[1])))
+			n, err := base64.StdEncoding.Decode(key, fields[1])
+			if err != nil {
+				break
+			}
+			return key[:n]
+		}
+	}
+	return fields[1]
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"github.com/coinbase/memcachedbetween/hashring"
+	"github.com/coinbase/memcachedbetween/pool"
+)
+
+// Router returns the server that requests for key are forwarded to. Requests without a key, like stat and
+// version, are routed with a nil key.
+type Router func(key []byte) *pool.Server
+
+// SingleServer routes every request to server
+func SingleServer(server *pool.Server) Router {
+	return func([]byte) *pool.Server {
+		return server
+	}
+}
+
+// HashRouter routes requests to the server that ring places their key on. servers must be in the same order as
+// the nodes the ring was created with.
+func HashRouter(ring *hashring.Ring, servers []*pool.Server) Router {
+	return func(key []byte) *pool.Server {
+		return servers[ring.Node(key)]
+	}
+}
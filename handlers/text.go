@@ -0,0 +1,716 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/pool"
+)
+
+// maxLineLength is the longest text protocol command or response line that will be read
+const maxLineLength = 64 * 1024
+
+var crlf = []byte("\r\n")
+
+// versionRequest is appended to pipelines of noreply commands, so that the end of the pipeline can be
+// found even if some of the noreply commands returned errors
+var versionRequest = []byte("version\r\n")
+
+// storageCommands are followed by a data block, the length of which is the fifth token of the command line
+var storageCommands = map[string]bool{
+	"set":     true,
+	"add":     true,
+	"replace": true,
+	"append":  true,
+	"prepend": true,
+	"cas":     true,
+}
+
+// retrievalCommands respond with any number of VALUE lines and data blocks, terminated by END
+var retrievalCommands = map[string]bool{
+	"get":  true,
+	"gets": true,
+	"gat":  true,
+	"gats": true,
+}
+
+// idempotentCommands can safely be sent to the server again if it isn't known whether they were executed
+var idempotentCommands = map[string]bool{
+	"get":     true,
+	"gets":    true,
+	"gat":     true,
+	"gats":    true,
+	"touch":   true,
+	"mg":      true,
+	"mn":      true,
+	"version": true,
+	"stats":   true,
+}
+
+// keyCommands are the commands other than storage and retrieval commands that take a key as their first argument
+var keyCommands = map[string]bool{
+	"delete": true,
+	"incr":   true,
+	"decr":   true,
+	"touch":  true,
+}
+
+// bufferedConn is a net.Conn with buffered reads, so the protocol can be detected from the first byte
+// and text protocol messages can be read line by line.
+type bufferedConn struct {
+	net.Conn
+	*bufio.Reader
+}
+
+func newBufferedConn(nc net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: nc, Reader: bufio.NewReader(nc)}
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.Reader.Read(p)
+}
+
+// textRequest is a text protocol command line and its data block, if any
+type textRequest struct {
+	wm      []byte
+	command string
+	keys    [][]byte // the key, or the keys of retrieval commands
+	meta    bool
+	noreply bool // also set for quiet meta requests, which are only responded to for hits and errors
+}
+
+// textResponseError is returned to the client in place of a response when a text request can't be forwarded
+type textResponseError string
+
+func (e textResponseError) Error() string { return string(e) }
+
+const (
+	errBadCommandLine = textResponseError("CLIENT_ERROR bad command line format")
+	errBadDataChunk   = textResponseError("CLIENT_ERROR bad data chunk")
+	errUnavailable    = textResponseError("SERVER_ERROR temporary failure")
+	errOutOfMemory    = textResponseError("SERVER_ERROR out of memory")
+	errTooLarge       = textResponseError("SERVER_ERROR object too large for cache")
+)
+
+// handleTextMessage reads a text protocol request from the client and round trips it
+func (c *connection) handleTextMessage() (log *zap.Logger, err error) {
+	log = c.log
+
+	req := c.pending
+	c.pending = nil
+	if req != nil {
+		log, err = c.textRoundTrip(req)
+		return
+	}
+
+	if req, err = readTextRequest(c.ctx, log, c.conn, c.address, c.id, 0, c.cfg.MaxItemSize, c.conn.Close); err != nil {
+		if re, ok := err.(textResponseError); ok {
+			err = nil
+			// Errors for noreply requests are dropped like memcached does, but quiet meta requests still get them
+			if req.meta || !req.noreply {
+				err = c.writeTextError(re)
+			}
+		}
+		return
+	}
+
+	if req.command == "quit" {
+		err = io.EOF
+		return
+	}
+
+	log, err = c.textRoundTrip(req)
+	return
+}
+
+// textRoundTrip forwards a pipeline of text requests starting with req to a single upstream connection.
+// noreply requests are forwarded for as long as the client has more of them buffered, and quiet meta
+// requests until a request that isn't quiet, typically mn, or until the client has nothing more buffered. A
+// version or mn request is appended to the pipeline if needed to find the end of the responses, since
+// responses to quiet requests are optional.
+// The pipeline also ends before a request for a key on another server. If the upstream fails, the request
+// ending the pipeline gets an error response, since responses to the other requests are optional anyway.
+func (c *connection) textRoundTrip(req *textRequest) (log *zap.Logger, err error) {
+	log = c.log
+
+	if c.textSpansServers(req) {
+		err = c.textBroadcastRoundTrip(req)
+		return
+	}
+	server := c.route(req.key())
+	if retrievalCommands[req.command] {
+		for _, key := range req.keys[1:] {
+			if c.route(key) != server {
+				return c.splitRetrieval(req)
+			}
+		}
+	}
+
+	if !req.noreply {
+		var res []byte
+		if log, res, err = c.textExchange(server, req); err != nil {
+			return
+		}
+		err = WriteWireMessage(c.ctx, log, res, c.conn, c.address, c.id, 0, c.conn.Close)
+		return
+	}
+
+	var conn pool.ConnectionWrapper
+	if conn, err = c.checkoutConnection(server); err != nil {
+		if err != pool.ErrCircuitOpen && err != pool.ErrBackingOff {
+			log.Warn("Failed to check out connection", zap.Error(err))
+		}
+		// noreply requests aren't answered, but quiet meta requests still get errors
+		res := c.failedTextResponse(req, err)
+		err = nil
+		if req.meta && !bytes.HasPrefix(res, []byte("EN")) {
+			err = WriteWireMessage(c.ctx, log, res, c.conn, c.address, c.id, 0, c.conn.Close)
+		}
+		return
+	}
+	upstream := newBufferedConn(conn.Conn())
+	drained := false
+	var upstreamErr error
+	defer func() {
+		if !drained || upstream.Buffered() > 0 {
+			// There may be unread responses on the wire, so the connection can't be reused.
+			_ = conn.Close()
+		}
+		server.Report(conn, upstreamErr)
+		_ = conn.Return()
+	}()
+
+	log = c.log.With(zap.Uint64("upstream_id", conn.ID()))
+	log.Debug("Connection checked out")
+	upstreamCfg := c.cfg.Upstream(conn.Address().String())
+
+	var requests []*textRequest
+	var last *textRequest // the request that ended the pipeline, which is answered after the pipeline's responses
+	var lastErr textResponseError
+	for {
+		if err = WriteWireMessage(c.ctx, log, req.wm, conn.Conn(), conn.Address().String(), conn.ID(), upstreamCfg.WriteTimeout, conn.Close); err != nil {
+			upstreamErr = err
+			err = c.failTextPipeline(log, req, nil, "", err)
+			return
+		}
+		requests = append(requests, req)
+		if !req.noreply {
+			break
+		}
+
+		var next *textRequest
+		if next, err = c.nextPipelinedRequest(log, req, server); err != nil {
+			re, ok := err.(textResponseError)
+			if !ok {
+				return
+			}
+			err = nil
+			last, lastErr = next, re
+			break
+		}
+		if next == nil || next.command == "quit" {
+			last = next
+			break
+		}
+		req = next
+	}
+
+	// The response to a sentinel request marks the end of the pipeline. One is appended to the pipeline
+	// unless the client's own request ending the pipeline is a sentinel request.
+	sentinel, sentinelCommand, sentinelPrefix := versionRequest, "version", []byte("VERSION ")
+	for _, r := range requests {
+		if r.meta {
+			sentinel, sentinelCommand, sentinelPrefix = noopMetaRequest, "mn", []byte("MN\r\n")
+			break
+		}
+	}
+	sentinels := 0
+	for _, r := range requests {
+		if r.command == sentinelCommand {
+			sentinels++
+		}
+	}
+	appended := requests[len(requests)-1].command != sentinelCommand
+	if appended {
+		if err = WriteWireMessage(c.ctx, log, sentinel, conn.Conn(), conn.Address().String(), conn.ID(), upstreamCfg.WriteTimeout, conn.Close); err != nil {
+			upstreamErr = err
+			err = c.failTextPipeline(log, requests[len(requests)-1], last, lastErr, err)
+			return
+		}
+		sentinels++
+	}
+
+	for !drained {
+		var res []byte
+		if res, err = readTextResponseUnit(c.ctx, log, upstream, conn.Address().String(), conn.ID(), upstreamCfg.ReadTimeout, conn.Close); err != nil {
+			upstreamErr = err
+			err = c.failTextPipeline(log, requests[len(requests)-1], last, lastErr, err)
+			return
+		}
+		if bytes.HasPrefix(res, sentinelPrefix) {
+			sentinels--
+			drained = sentinels == 0
+			if drained && appended {
+				break
+			}
+		}
+		if err = WriteWireMessage(c.ctx, log, res, c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+			return
+		}
+	}
+
+	err = c.endTextPipeline(last, lastErr)
+	return
+}
+
+// endTextPipeline answers the request last that ended a pipeline without being forwarded, if any. It either had
+// the error lastErr or is a quit.
+func (c *connection) endTextPipeline(last *textRequest, lastErr textResponseError) error {
+	switch {
+	case lastErr != "" && (last.meta || !last.noreply):
+		// Errors for noreply requests are dropped like memcached does, but quiet meta requests still get them
+		return c.writeTextError(lastErr)
+	case last != nil && last.command == "quit":
+		return io.EOF
+	}
+	return nil
+}
+
+// failTextPipeline answers a pipeline after the upstream failed with cause. end is the last request that was
+// forwarded, which gets an error response unless it is noreply, and last is answered like in endTextPipeline.
+func (c *connection) failTextPipeline(log *zap.Logger, end *textRequest, last *textRequest, lastErr textResponseError, cause error) error {
+	c.upstreamFailed(log, cause)
+	if !end.noreply {
+		if err := WriteWireMessage(c.ctx, log, c.failedTextResponse(end, cause), c.conn, c.address, c.id, 0, c.conn.Close); err != nil {
+			return err
+		}
+	}
+	return c.endTextPipeline(last, lastErr)
+}
+
+// nextPipelinedRequest reads the request that follows prev in a pipeline to server from the client, or returns
+// nil if the pipeline ends with prev. Pipelines only continue with requests that have already been buffered, so
+// that the upstream connection isn't kept checked out while waiting for the client. Meta pipelines continue with
+// any request, and other pipelines only with noreply requests. Requests routed to another server end the
+// pipeline, and are kept to be handled as the next message.
+func (c *connection) nextPipelinedRequest(log *zap.Logger, prev *textRequest, server *pool.Server) (*textRequest, error) {
+	fields, ok := c.textRequestBuffered()
+	if !ok || (!prev.meta && !noreply(fields)) {
+		return nil, nil
+	}
+	next, err := readTextRequest(c.ctx, log, c.conn, c.address, c.id, 0, c.cfg.MaxItemSize, c.conn.Close)
+	if err == nil && ((next.key() != nil && c.route(next.key()) != server) || c.textSpansServers(next)) {
+		c.pending = next
+		return nil, nil
+	}
+	return next, err
+}
+
+// textRequestBuffered returns the fields of the client's next command line if it has already been buffered in full,
+// along with its data block if it has one
+func (c *connection) textRequestBuffered() ([][]byte, bool) {
+	buf, _ := c.conn.Peek(c.conn.Buffered())
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	fields := bytes.Fields(buf[:i])
+	if len(fields) == 0 {
+		return fields, true
+	}
+	if sizeIndex := dataSizeIndex(string(fields[0])); sizeIndex > 0 && len(fields) > sizeIndex {
+		if size, err := strconv.ParseUint(string(fields[sizeIndex]), 10, 31); err == nil && uint64(len(buf)-i-1) < size+2 {
+			return fields, false
+		}
+	}
+	return fields, true
+}
+
+// splitRetrieval forwards a retrieval request to every server that its keys are routed to, and responds with the
+// values from all of them. The keys of a server that answers with an error miss, so the hits from the other
+// servers are still returned, unless every server failed, in which case the first error is returned.
+func (c *connection) splitRetrieval(req *textRequest) (log *zap.Logger, err error) {
+	log = c.log
+
+	fields := bytes.Fields(req.wm)
+	prefix := fields[:len(fields)-len(req.keys)]
+
+	var servers []*pool.Server
+	keys := map[*pool.Server][][]byte{}
+	for _, key := range req.keys {
+		server := c.route(key)
+		if _, ok := keys[server]; !ok {
+			servers = append(servers, server)
+		}
+		keys[server] = append(keys[server], key)
+	}
+
+	var values, failed []byte
+	answered := 0
+	for _, server := range servers {
+		sub := &textRequest{
+			wm:      append(bytes.Join(append(append([][]byte{}, prefix...), keys[server]...), []byte(" ")), crlf...),
+			command: req.command,
+			keys:    keys[server],
+		}
+		var res []byte
+		if log, res, err = c.textExchange(server, sub); err != nil {
+			return
+		}
+		if !bytes.HasSuffix(res, []byte("END\r\n")) {
+			// the server answered with an error instead of the values, so its keys miss
+			if failed == nil {
+				failed = res
+			}
+			continue
+		}
+		values = append(values, res[:len(res)-len("END\r\n")]...)
+		answered++
+	}
+
+	if answered == 0 {
+		err = WriteWireMessage(c.ctx, log, failed, c.conn, c.address, c.id, 0, c.conn.Close)
+		return
+	}
+	err = WriteWireMessage(c.ctx, log, append(values, "END\r\n"...), c.conn, c.address, c.id, 0, c.conn.Close)
+	return
+}
+
+// textExchange forwards a single request that isn't noreply to server, and returns the response. A request that
+// failed on a dead connection is forwarded again on a new one if that is safe, and an error response is returned if
+// the request can't be forwarded or answered.
+func (c *connection) textExchange(server *pool.Server, req *textRequest) (log *zap.Logger, res []byte, err error) {
+	log = c.log
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		var conn pool.ConnectionWrapper
+		if conn, err = c.checkoutConnection(server); err != nil {
+			if err != pool.ErrCircuitOpen && err != pool.ErrBackingOff {
+				log.Warn("Failed to check out connection", zap.Error(err))
+			}
+			if attempt > 0 {
+				c.retried("", false)
+			}
+			res, err = c.failedTextResponse(req, err), nil
+			return
+		}
+		address := conn.Address().String()
+
+		var written bool
+		var upstreamErr error
+		log, res, written, upstreamErr = c.exchange(server, conn, req)
+		if attempt > 0 {
+			c.retried(address, upstreamErr == nil)
+		}
+		if upstreamErr == nil {
+			return
+		}
+		// A request that was written in part isn't executed by the server, so it is safe to write again.
+		if !c.retry(attempt, start, upstreamErr) || (written && !idempotentCommands[req.command]) {
+			c.upstreamFailed(log, upstreamErr)
+			res = c.failedTextResponse(req, upstreamErr)
+			return
+		}
+		log.Debug("Retrying request", zap.Error(upstreamErr))
+	}
+}
+
+// exchange writes req to conn and reads the response. written is set once the request has been written in full,
+// and err is the error reading or writing conn, if any.
+func (c *connection) exchange(server *pool.Server, conn pool.ConnectionWrapper, req *textRequest) (log *zap.Logger, res []byte, written bool, err error) {
+	upstream := newBufferedConn(conn.Conn())
+	drained := false
+	defer func() {
+		if !drained || upstream.Buffered() > 0 {
+			// There may be unread responses on the wire, so the connection can't be reused.
+			_ = conn.Close()
+		}
+		server.Report(conn, err)
+		_ = conn.Return()
+	}()
+
+	log = c.log.With(zap.Uint64("upstream_id", conn.ID()))
+	log.Debug("Connection checked out")
+	upstreamCfg := c.cfg.Upstream(conn.Address().String())
+
+	if err = WriteWireMessage(c.ctx, log, req.wm, conn.Conn(), conn.Address().String(), conn.ID(), upstreamCfg.WriteTimeout, conn.Close); err != nil {
+		return
+	}
+	written = true
+	if res, err = readTextResponse(c.ctx, log, upstream, conn.Address().String(), conn.ID(), upstreamCfg.ReadTimeout, conn.Close, req); err != nil {
+		return
+	}
+	drained = true
+	return
+}
+
+// failedTextResponse returns the response to req that couldn't be forwarded or answered because of cause.
+// Retrievals miss if the circuit breaker is open and BreakerMiss is set, and other requests fail with out of
+// memory if the pool is exhausted, and with a temporary failure otherwise.
+func (c *connection) failedTextResponse(req *textRequest, cause error) []byte {
+	miss := c.cfg.BreakerMiss && cause == pool.ErrCircuitOpen
+	switch {
+	case miss && retrievalCommands[req.command]:
+		return []byte("END\r\n")
+	case miss && req.command == "mg":
+		return []byte("EN\r\n")
+	case cause == pool.ErrWaitQueueTimeout:
+		return append([]byte(errOutOfMemory), crlf...)
+	}
+	return append([]byte(errUnavailable), crlf...)
+}
+
+func (c *connection) writeTextError(re textResponseError) error {
+	return WriteWireMessage(c.ctx, c.log, append([]byte(re), crlf...), c.conn, c.address, c.id, 0, c.conn.Close)
+}
+
+// key returns the key of the request, or the first key of a retrieval request, or nil if it has none
+func (r *textRequest) key() []byte {
+	if len(r.keys) == 0 {
+		return nil
+	}
+	return r.keys[0]
+}
+
+// textKeys returns the keys of a command line. Base64 encoded meta keys are decoded, since they are stored
+// as the decoded binary key.
+func textKeys(fields [][]byte) [][]byte {
+	command := string(fields[0])
+	switch {
+	case command == "gat" || command == "gats":
+		if len(fields) > 2 {
+			return fields[2:]
+		}
+	case retrievalCommands[command]:
+		return fields[1:]
+	case command == "mn":
+	case metaCommands[command]:
+		if len(fields) > 1 {
+			return [][]byte{metaKey(fields)}
+		}
+	case storageCommands[command] || keyCommands[command]:
+		if len(fields) > 1 {
+			return fields[1:2]
+		}
+	}
+	return nil
+}
+
+// noreply returns true if the command line fields are for a command that won't be responded to
+func noreply(fields [][]byte) bool {
+	return len(fields) > 1 && string(fields[len(fields)-1]) == "noreply" && !retrievalCommands[string(fields[0])]
+}
+
+// readTextRequest reads a text protocol command line, and its data block for storage commands, from nc.
+// A textResponseError is returned along with the request if it should be answered with an error instead
+// of being forwarded. Data blocks longer than maxValueLength are skipped, unless it is 0.
+func readTextRequest(ctx context.Context, log *zap.Logger, nc *bufferedConn, address string, id uint64, readTimeout time.Duration, maxValueLength int, close func() error) (*textRequest, error) {
+	line, err := readTextLine(ctx, log, nc, address, id, readTimeout, close)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bytes.Fields(line)
+	req := &textRequest{wm: line}
+	if len(fields) == 0 {
+		return req, nil
+	}
+	req.command = string(fields[0])
+	req.meta = metaCommands[req.command]
+	if req.meta {
+		req.noreply = metaQuiet(fields)
+	} else {
+		req.noreply = noreply(fields)
+	}
+	req.keys = textKeys(fields)
+
+	if sizeIndex := dataSizeIndex(req.command); sizeIndex > 0 {
+		if len(fields) <= sizeIndex {
+			return req, errBadCommandLine
+		}
+		size, err := strconv.ParseUint(string(fields[sizeIndex]), 10, 31)
+		if err != nil {
+			return req, errBadCommandLine
+		}
+		if maxValueLength > 0 && size > uint64(maxValueLength) {
+			// Skip the data block, like memcached does, so that the connection can be used for the next request.
+			if _, err = io.CopyN(ioutil.Discard, nc, int64(size)+2); err != nil {
+				_ = close()
+				return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "incomplete read of data block"}
+			}
+			return req, errTooLarge
+		}
+		if req.wm, err = readTextData(nc, address, id, close, line, int(size)); err != nil {
+			return req, err
+		}
+	}
+
+	return req, nil
+}
+
+// dataSizeIndex returns the index of the data block length among the fields of a command line, or 0 if command
+// doesn't have a data block. The length is the fifth token of storage commands, and the third token of ms.
+func dataSizeIndex(command string) int {
+	switch {
+	case storageCommands[command]:
+		return 4
+	case command == "ms":
+		return 2
+	}
+	return 0
+}
+
+// readTextResponse reads the full response to req from nc
+func readTextResponse(ctx context.Context, log *zap.Logger, nc *bufferedConn, address string, id uint64, readTimeout time.Duration, close func() error, req *textRequest) ([]byte, error) {
+	var res []byte
+	for {
+		unit, err := readTextResponseUnit(ctx, log, nc, address, id, readTimeout, close)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, unit...)
+
+		switch {
+		case errorLine(unit):
+			return res, nil
+		case retrievalCommands[req.command]:
+			if bytes.Equal(unit, []byte("END\r\n")) {
+				return res, nil
+			}
+		case req.command == "stats":
+			if !bytes.HasPrefix(unit, []byte("STAT ")) && !bytes.HasPrefix(unit, []byte("ITEM ")) && !bytes.HasPrefix(unit, []byte("PREFIX ")) {
+				return res, nil
+			}
+		default:
+			return res, nil
+		}
+	}
+}
+
+// readTextResponseUnit reads a single response line from nc, along with its data block if it is a VALUE or a
+// meta VA line
+func readTextResponseUnit(ctx context.Context, log *zap.Logger, nc *bufferedConn, address string, id uint64, readTimeout time.Duration, close func() error) ([]byte, error) {
+	line, err := readTextLine(ctx, log, nc, address, id, readTimeout, close)
+	if err != nil {
+		return nil, err
+	}
+
+	// VALUE <key> <flags> <bytes> [<cas unique>] or VA <bytes> <flags>*
+	sizeIndex := 0
+	switch {
+	case bytes.HasPrefix(line, []byte("VALUE ")):
+		sizeIndex = 3
+	case bytes.HasPrefix(line, []byte("VA ")):
+		sizeIndex = 1
+	default:
+		return line, nil
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) <= sizeIndex {
+		_ = close()
+		return nil, pool.ConnectionError{Address: address, ID: id, Message: "malformed value line"}
+	}
+	size, err := strconv.ParseUint(string(fields[sizeIndex]), 10, 31)
+	if err != nil {
+		_ = close()
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "malformed value line"}
+	}
+	res, err := readTextData(nc, address, id, close, line, int(size))
+	if err == errBadDataChunk {
+		_ = close()
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "malformed data block"}
+	}
+	return res, err
+}
+
+func errorLine(line []byte) bool {
+	return bytes.Equal(line, []byte("ERROR\r\n")) ||
+		bytes.HasPrefix(line, []byte("CLIENT_ERROR")) ||
+		bytes.HasPrefix(line, []byte("SERVER_ERROR"))
+}
+
+// readTextLine reads a line terminated by \r\n from nc
+func readTextLine(ctx context.Context, log *zap.Logger, nc *bufferedConn, address string, id uint64, readTimeout time.Duration, close func() error) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		// We close the connection because we don't know if there is an unread message on the wire.
+		_ = close()
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: ctx.Err(), Message: "failed to read"}
+	default:
+	}
+
+	var deadline time.Time
+	if readTimeout != 0 {
+		deadline = time.Now().Add(readTimeout)
+	}
+
+	if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
+	}
+
+	if err := nc.SetReadDeadline(deadline); err != nil {
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "failed to set read deadline"}
+	}
+
+	var line []byte
+	for {
+		chunk, err := nc.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			// We close the connection because we don't know if there are other bytes left to read.
+			_ = close()
+			if err == io.EOF && len(line) == 0 {
+				return nil, err
+			}
+			return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "incomplete read of line"}
+		}
+		if len(line) > maxLineLength {
+			_ = close()
+			return nil, pool.ConnectionError{Address: address, ID: id, Message: "line too long"}
+		}
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		line = append(line[:len(line)-1], crlf...)
+	}
+
+	log.Debug("Read line", zap.String("address", address), zap.Int("length", len(line)), zap.ByteString("line", line[:len(line)-2]))
+
+	return line, nil
+}
+
+// readTextData appends a data block of size bytes and its \r\n terminator from nc to line. The block is
+// buffered as it arrives rather than allocated up front, so a size that isn't followed by as much data doesn't
+// cost more memory than the data that was sent.
+func readTextData(nc *bufferedConn, address string, id uint64, close func() error, line []byte, size int) ([]byte, error) {
+	prealloc := size + 2
+	if prealloc > maxLineLength {
+		prealloc = maxLineLength
+	}
+	wm := bytes.NewBuffer(make([]byte, 0, len(line)+prealloc))
+	wm.Write(line)
+	if _, err := io.CopyN(wm, nc, int64(size)+2); err != nil {
+		// We close the connection because we don't know if there are other bytes left to read.
+		_ = close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "incomplete read of data block"}
+	}
+	if !bytes.HasSuffix(wm.Bytes(), crlf) {
+		return nil, errBadDataChunk
+	}
+	return wm.Bytes(), nil
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coinbase/memcachedbetween/config"
+)
+
+func (f *fakeMemcached) serveText(conn *bufferedConn) {
+	for {
+		line, err := conn.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			fields = [][]byte{nil}
+		}
+		if len(fields) > 1 && string(fields[1]) == deadKey {
+			return
+		}
+
+		var res []byte
+		f.Lock()
+		switch string(fields[0]) {
+		case "get":
+			for _, key := range fields[1:] {
+				if value, ok := f.items[string(key)]; ok {
+					res = append(res, fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)...)
+				}
+			}
+			res = append(res, "END\r\n"...)
+		case "set":
+			size, _ := strconv.Atoi(string(fields[4]))
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(conn, value); err != nil {
+				f.Unlock()
+				return
+			}
+			if size > 3 {
+				res = []byte("SERVER_ERROR object too large for cache\r\n")
+			} else {
+				f.items[string(fields[1])] = value[:size]
+				if !noreply(fields) {
+					res = []byte("STORED\r\n")
+				}
+			}
+		case "mg":
+			value, ok := f.items[string(fields[1])]
+			switch {
+			case ok:
+				res = []byte(fmt.Sprintf("VA %d\r\n%s\r\n", len(value), value))
+			case !metaQuiet(fields):
+				res = []byte("EN\r\n")
+			}
+		case "ms":
+			size, _ := strconv.Atoi(string(fields[2]))
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(conn, value); err != nil {
+				f.Unlock()
+				return
+			}
+			f.items[string(fields[1])] = value[:size]
+			if !metaQuiet(fields) {
+				res = []byte("HD\r\n")
+			}
+		case "mn":
+			res = []byte("MN\r\n")
+		case "stats":
+			res = []byte("STAT pid 1\r\nSTAT uptime 1\r\nEND\r\n")
+		case "version":
+			res = []byte("VERSION 1.6.0\r\n")
+		case "flush_all":
+			f.items = map[string][]byte{}
+			if !noreply(fields) {
+				res = []byte("OK\r\n")
+			}
+		default:
+			res = []byte("ERROR\r\n")
+		}
+		f.Unlock()
+		if _, err := conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+func roundTripText(t *testing.T, conn *bufio.Reader, lines int) string {
+	var res []byte
+	for i := 0; i < lines; i++ {
+		line, err := conn.ReadBytes('\n')
+		assert.NoError(t, err)
+		res = append(res, line...)
+	}
+	return string(res)
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 1\r\nx\r\nget a b\r\n"))
+	}()
+	assert.Equal(t, "STORED\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+
+	go func() {
+		_, _ = conn.Write([]byte("stats\r\nbogus\r\n"))
+	}()
+	assert.Equal(t, "STAT pid 1\r\nSTAT uptime 1\r\nEND\r\n", roundTripText(t, r, 3))
+	assert.Equal(t, "ERROR\r\n", roundTripText(t, r, 1))
+}
+
+func TestTextNoreply(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 1 noreply\r\nx\r\nset b 0 0 4 noreply\r\nyyyy\r\nset c 0 0 1 noreply\r\nz\r\nget a b c\r\n"))
+	}()
+	assert.Equal(t, "SERVER_ERROR object too large for cache\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nVALUE c 0 1\r\nz\r\nEND\r\n", roundTripText(t, r, 5))
+}
+
+func TestTextBadCommandLine(t *testing.T) {
+	conn := startProxy(t, &fakeMemcached{items: map[string][]byte{}})
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 x\r\nset a 0 0 1\r\nxx\r\nversion\r\n"))
+	}()
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "CLIENT_ERROR bad data chunk\r\n", roundTripText(t, r, 1))
+	// the \n after the short data block is read as an empty command line
+	assert.Equal(t, "ERROR\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "VERSION 1.6.0\r\n", roundTripText(t, r, 1))
+}
+
+func TestTextTooLarge(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	// the data block is skipped without being forwarded, and the next request is read after it
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 17\r\n" + strings.Repeat("x", 17) + "\r\nms b 17 q\r\n" + strings.Repeat("y", 17) + "\r\nget a b\r\n"))
+	}()
+	assert.Equal(t, "SERVER_ERROR object too large for cache\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "SERVER_ERROR object too large for cache\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "END\r\n", roundTripText(t, r, 1))
+	assert.Empty(t, f.items)
+}
+
+func TestTextDataNotSent(t *testing.T) {
+	client, proxy := net.Pipe()
+	go func() {
+		_, _ = client.Write([]byte("xx"))
+		_ = client.Close()
+	}()
+
+	// a size that isn't followed by as much data fails once the data ends, without allocating it up front
+	_, err := readTextData(newBufferedConn(proxy), "", 0, proxy.Close, []byte("VA 2147483647\r\n"), 1<<31-1)
+	assert.Error(t, err)
+}
+
+func TestMetaPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("ms a 1 q\r\nx\r\nms b 1 T0 q\r\ny\r\nmn\r\n"))
+	}()
+	assert.Equal(t, "MN\r\n", roundTripText(t, r, 1))
+
+	go func() {
+		_, _ = conn.Write([]byte("mg a v q\r\nmg missing v q\r\nmg b v q\r\nmn\r\n"))
+	}()
+	assert.Equal(t, "VA 1\r\nx\r\nVA 1\r\ny\r\nMN\r\n", roundTripText(t, r, 5))
+
+	// a pipeline terminated by a request other than mn
+	go func() {
+		_, _ = conn.Write([]byte("mg missing v q\r\nmg a v q\r\nmg missing v\r\nmg b v\r\n"))
+	}()
+	assert.Equal(t, "VA 1\r\nx\r\nEN\r\n", roundTripText(t, r, 3))
+	assert.Equal(t, "VA 1\r\ny\r\n", roundTripText(t, r, 2))
+}
+
+func TestIdleMetaPipeline(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{}}
+	server := startServer(t, f)
+	conn := startRoutedProxy(t, SingleServer(server))
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	// a quiet request that isn't followed by mn yet doesn't keep the upstream connection checked out
+	go func() {
+		_, _ = conn.Write([]byte("ms a 1 q\r\nx\r\n"))
+	}()
+	assert.Eventually(t, func() bool {
+		return f.get("a") != nil && server.Stats().CheckedOut == 0
+	}, time.Second, time.Millisecond)
+
+	go func() {
+		_, _ = conn.Write([]byte("mn\r\n"))
+	}()
+	assert.Equal(t, "MN\r\n", roundTripText(t, r, 1))
+}
+
+func TestTextRouted(t *testing.T) {
+	a := &fakeMemcached{items: map[string][]byte{}}
+	b := &fakeMemcached{items: map[string][]byte{}}
+	conn := startRoutedProxy(t, prefixRouter(t, a, b))
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 1 noreply\r\nx\r\nset b 0 0 1 noreply\r\ny\r\nget a b c\r\n"))
+	}()
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nVALUE b 0 1\r\ny\r\nEND\r\n", roundTripText(t, r, 5))
+	assert.Equal(t, []byte("x"), a.get("a"))
+	assert.Equal(t, []byte("y"), b.get("b"))
+
+	go func() {
+		_, _ = conn.Write([]byte("mg b v q\r\nmg a v q\r\nmn\r\n"))
+	}()
+	assert.Equal(t, "VA 1\r\ny\r\nVA 1\r\nx\r\nMN\r\n", roundTripText(t, r, 5))
+}
+
+func TestTextBroadcast(t *testing.T) {
+	a := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	b := &fakeMemcached{items: map[string][]byte{"b": []byte("y")}}
+	conn := startSpanningProxy(t, a, b)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("flush_all\r\nversion\r\nstats\r\n"))
+	}()
+	assert.Equal(t, "OK\r\n", roundTripText(t, r, 1))
+	assert.Nil(t, a.get("a"))
+	assert.Nil(t, b.get("b"))
+	assert.Equal(t, "VERSION 1.6.0\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "SERVER_ERROR stats aren't supported across several servers\r\n", roundTripText(t, r, 1))
+
+	// a noreply flush after noreply requests ends their pipeline
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 1 noreply\r\nx\r\nflush_all noreply\r\nget a\r\n"))
+	}()
+	assert.Equal(t, "END\r\n", roundTripText(t, r, 1))
+}
+
+func TestTextSplitRetrievalFailure(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	conn := startRoutedProxy(t, openRouter(t, f, startOpenServer(t)))
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	// the keys of the failed server miss, and the hits of the others are still returned
+	go func() {
+		_, _ = conn.Write([]byte("get a b\r\nget b\r\n"))
+	}()
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+	assert.Equal(t, "SERVER_ERROR temporary failure\r\n", roundTripText(t, r, 1))
+}
+
+func TestTextUpstreamFailure(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	conn := startProxy(t, f)
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("get dead\r\nmg a v q\r\nmg dead v q\r\nmn\r\nget a\r\n"))
+	}()
+	assert.Equal(t, "SERVER_ERROR temporary failure\r\n", roundTripText(t, r, 1))
+	// the response to the quiet request before the failure is still forwarded
+	assert.Equal(t, "VA 1\r\nx\r\n", roundTripText(t, r, 2))
+	assert.Equal(t, "SERVER_ERROR temporary failure\r\n", roundTripText(t, r, 1))
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+}
+
+func TestTextRetry(t *testing.T) {
+	f := &fakeMemcached{items: map[string][]byte{"a": []byte("x")}}
+	conn := startConfiguredProxy(t, SingleServer(startServer(t, f)), &config.Config{ReadTimeout: time.Second, WriteTimeout: time.Second, Retries: 1, RetryTimeout: time.Second})
+	defer conn.Close()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	r := bufio.NewReader(conn)
+
+	go func() {
+		_, _ = conn.Write([]byte("get a\r\n"))
+	}()
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+
+	f.hangup()
+	go func() {
+		_, _ = conn.Write([]byte("get a\r\n"))
+	}()
+	assert.Equal(t, "VALUE a 0 1\r\nx\r\nEND\r\n", roundTripText(t, r, 3))
+
+	f.hangup()
+	go func() {
+		_, _ = conn.Write([]byte("set a 0 0 1\r\ny\r\n"))
+	}()
+	assert.Equal(t, "SERVER_ERROR temporary failure\r\n", roundTripText(t, r, 1))
+}
@@ -0,0 +1,135 @@
+// Package hashring implements the consistent hashing used by memcached clients to pick the node that stores a key,
+// so that a single proxy endpoint places keys on the same nodes as clients that distribute keys themselves.
+package hashring
+
+import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Algorithm is a consistent hashing scheme
+type Algorithm string
+
+const (
+	// Ketama is the weighted ketama scheme of libmemcached, with 160 MD5 points per node. Points are named
+	// host-index, or host:port-index for ports other than 11211, so spymemcached, which names them after the
+	// full socket address, places keys differently.
+	Ketama Algorithm = "ketama"
+	// Dalli is the scheme of the Dalli ruby client, with 160 SHA1 points per node and CRC32 key hashes
+	Dalli Algorithm = "dalli"
+)
+
+// pointsPerNode is the number of points each node has on the continuum for both algorithms
+const pointsPerNode = 160
+
+// defaultPort is left out of the point names of libmemcached ketama nodes
+const defaultPort = "11211"
+
+// Algorithms lists the supported algorithms
+var Algorithms = []Algorithm{Ketama, Dalli}
+
+type point struct {
+	value uint32
+	node  int
+}
+
+// Ring maps keys to nodes
+type Ring struct {
+	algorithm Algorithm
+	nodes     int
+	points    []point
+}
+
+// New creates a ring for nodes, which are host:port addresses (or socket paths) named the same way as they are
+// configured in clients
+func New(algorithm Algorithm, nodes []string) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes to hash %s keys to", algorithm)
+	}
+
+	r := &Ring{algorithm: algorithm, nodes: len(nodes)}
+	switch algorithm {
+	case Ketama:
+		for i, node := range nodes {
+			name := node
+			if host, port, err := splitHostPort(node); err == nil && port == defaultPort {
+				name = host
+			}
+			for j := 0; j < pointsPerNode/4; j++ {
+				// #nosec
+				digest := md5.Sum([]byte(name + "-" + strconv.Itoa(j)))
+				for k := 0; k < 4; k++ {
+					r.points = append(r.points, point{value: binary.LittleEndian.Uint32(digest[k*4:]), node: i})
+				}
+			}
+		}
+	case Dalli:
+		if len(nodes) == 1 {
+			// Dalli doesn't build a continuum for a single server
+			return r, nil
+		}
+		for i, node := range nodes {
+			for j := 0; j < pointsPerNode; j++ {
+				// #nosec
+				digest := sha1.Sum([]byte(node + ":" + strconv.Itoa(j)))
+				value, _ := strconv.ParseUint(hex.EncodeToString(digest[:4]), 16, 32)
+				r.points = append(r.points, point{value: uint32(value), node: i})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown hashing algorithm: %s", algorithm)
+	}
+
+	sort.SliceStable(r.points, func(i, j int) bool {
+		return r.points[i].value < r.points[j].value
+	})
+	return r, nil
+}
+
+// Node returns the index of the node that key is stored on
+func (r *Ring) Node(key []byte) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+
+	switch r.algorithm {
+	case Dalli:
+		// Dalli picks the last point at or below the hash, wrapping around to the last point
+		hash := crc32.ChecksumIEEE(key)
+		i := sort.Search(len(r.points), func(i int) bool {
+			return r.points[i].value > hash
+		})
+		if i == 0 {
+			i = len(r.points)
+		}
+		return r.points[i-1].node
+	default:
+		// ketama picks the first point at or above the hash, wrapping around to the first point
+		// #nosec
+		digest := md5.Sum(key)
+		hash := binary.LittleEndian.Uint32(digest[:4])
+		i := sort.Search(len(r.points), func(i int) bool {
+			return r.points[i].value >= hash
+		})
+		if i == len(r.points) {
+			i = 0
+		}
+		return r.points[i].node
+	}
+}
+
+// splitHostPort splits host:port addresses, leaving the port empty for socket paths
+func splitHostPort(node string) (string, string, error) {
+	i := strings.LastIndex(node, ":")
+	if i < 0 {
+		return node, "", fmt.Errorf("missing port in %s", node)
+	}
+	return node[:i], node[i+1:], nil
+}
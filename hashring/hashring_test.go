@@ -0,0 +1,112 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nodes = []string{"cache-1:11211", "cache-2:11211", "cache-3:11211"}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	_, err := New("modula", nodes)
+	assert.Error(t, err)
+
+	_, err = New(Ketama, nil)
+	assert.Error(t, err)
+}
+
+func TestDistribution(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		r, err := New(algorithm, nodes)
+		assert.NoError(t, err)
+		assert.Len(t, r.points, len(nodes)*pointsPerNode)
+
+		counts := make([]int, len(nodes))
+		for i := 0; i < 3000; i++ {
+			counts[r.Node([]byte(fmt.Sprintf("key%d", i)))]++
+		}
+		for _, c := range counts {
+			assert.InDelta(t, 1000, c, 250, "%s: %v", algorithm, counts)
+		}
+	}
+}
+
+func TestRemovedNode(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		all, err := New(algorithm, nodes)
+		assert.NoError(t, err)
+		fewer, err := New(algorithm, nodes[:2])
+		assert.NoError(t, err)
+
+		// only keys on the removed node move
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			if n := all.Node(key); n < 2 {
+				assert.Equal(t, n, fewer.Node(key), "%s: %s", algorithm, key)
+			}
+		}
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		r, err := New(algorithm, nodes[:1])
+		assert.NoError(t, err)
+		assert.Equal(t, 0, r.Node([]byte("key")))
+	}
+}
+
+// placements are known keys and the nodes the reference clients store them on, for a cluster with a node on a port
+// other than the default one, which changes the point names of libmemcached. They were computed with scripts that
+// follow the continuum and lookup code of libmemcached 1.0 (update_continuum with KETAMA_WEIGHTED) and Dalli 2.7
+// (Dalli::Ring) line by line, independently of this package.
+var placements = map[Algorithm][]struct {
+	key  string
+	node string
+}{
+	Ketama: {
+		{"foo", "10.0.1.3:11211"},
+		{"bar", "10.0.1.3:11211"},
+		{"baz", "cache-4:11212"},
+		{"user:1", "10.0.1.1:11211"},
+		{"user:2", "10.0.1.3:11211"},
+		{"session:abcdef", "10.0.1.2:11211"},
+		{"a", "10.0.1.3:11211"},
+		{"memcachedbetween", "10.0.1.2:11211"},
+		{"key99", "10.0.1.1:11211"},
+	},
+	Dalli: {
+		{"foo", "10.0.1.1:11211"},
+		{"bar", "10.0.1.1:11211"},
+		{"baz", "10.0.1.1:11211"},
+		{"user:1", "10.0.1.2:11211"},
+		{"user:2", "10.0.1.2:11211"},
+		{"session:abcdef", "10.0.1.2:11211"},
+		{"a", "10.0.1.3:11211"},
+		{"memcachedbetween", "cache-4:11212"},
+		{"key99", "10.0.1.3:11211"},
+	},
+}
+
+func TestClientPlacement(t *testing.T) {
+	cluster := []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211", "cache-4:11212"}
+	for algorithm, keys := range placements {
+		r, err := New(algorithm, cluster)
+		assert.NoError(t, err)
+		for _, k := range keys {
+			assert.Equal(t, k.node, cluster[r.Node([]byte(k.key))], "%s: %s", algorithm, k.key)
+		}
+	}
+}
+
+func TestWrapAround(t *testing.T) {
+	r := &Ring{algorithm: Ketama, points: []point{{value: 10, node: 0}, {value: 20, node: 1}}}
+	assert.Equal(t, 0, r.Node(nil))
+
+	r = &Ring{algorithm: Dalli, points: []point{{value: 0, node: 0}, {value: 1, node: 1}}}
+	assert.Equal(t, 1, r.Node([]byte("key")))
+	r.points[1].value = 0xffffffff
+	assert.Equal(t, 0, r.Node([]byte("key")))
+}
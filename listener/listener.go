@@ -1,6 +1,7 @@
 package listener
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"runtime/debug"
@@ -18,6 +19,7 @@ import (
 )
 
 const restartSleep = 1 * time.Second
+const handshakeTimeout = 10 * time.Second
 
 type Listener struct {
 	log    *zap.Logger
@@ -28,16 +30,28 @@ type Listener struct {
 	unlink   bool
 	handler  ConnectionHandler
 	shutdown ShutdownHandler
+	tls      *tls.Config
 
 	quit chan interface{}
 	kill chan interface{}
 }
 
-type ConnectionHandler func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{})
+type ConnectionHandler func(log *zap.Logger, conn net.Conn, id uint64, peer Peer, kill chan interface{})
 type ShutdownHandler func()
 
-func New(log *zap.Logger, sd *statsd.Client, network, address string, unlink bool, handler ConnectionHandler, shutdown ShutdownHandler) (*Listener, error) {
-	return &Listener{
+// Option configures a Listener
+type Option func(*Listener)
+
+// WithTLS configures the listener to terminate TLS with config. Handshakes complete before connections are
+// passed to the ConnectionHandler.
+func WithTLS(config *tls.Config) Option {
+	return func(l *Listener) {
+		l.tls = config
+	}
+}
+
+func New(log *zap.Logger, sd *statsd.Client, network, address string, unlink bool, handler ConnectionHandler, shutdown ShutdownHandler, opts ...Option) (*Listener, error) {
+	l := &Listener{
 		log:    log,
 		statsd: sd,
 
@@ -49,7 +63,11 @@ func New(log *zap.Logger, sd *statsd.Client, network, address string, unlink boo
 
 		quit: make(chan interface{}),
 		kill: make(chan interface{}),
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l, nil
 }
 
 func (l *Listener) Run() error {
@@ -104,6 +122,9 @@ func (l *Listener) listen() error {
 	if err != nil {
 		return err
 	}
+	if l.tls != nil {
+		li = tls.NewListener(li, l.tls)
+	}
 	defer func() {
 		_ = li.Close()
 	}()
@@ -157,8 +178,18 @@ func (l *Listener) accept(li net.Listener) {
 				closed("connection_closed", []string{})
 			}()
 
+			peer, err := l.handshake(c)
+			if err != nil {
+				log.Warn("TLS handshake failed", zap.Error(err))
+				_ = l.statsd.Incr("tls_handshake_failed", []string{}, 1)
+				return
+			}
+			if peer.Identity != "" {
+				log = log.With(zap.String("peer", peer.Identity))
+			}
+
 			log.Info("Accept")
-			l.handler(log, c, id, l.kill)
+			l.handler(log, c, id, peer, l.kill)
 		}()
 
 		go func() {
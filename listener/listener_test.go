@@ -0,0 +1,146 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memcachedbetween")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "client-a", x509.ExtKeyUsageClientAuth)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	assert.NoError(t, ioutil.WriteFile(certFile, serverCert, 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, serverKey, 0600))
+
+	serverTLS, err := config.TLSConfig{Enabled: true, CAFile: caFile, CertFile: certFile, KeyFile: keyFile}.ServerConfig(nil)
+	assert.NoError(t, err)
+
+	peers := make(chan Peer, 1)
+	handler := func(log *zap.Logger, conn net.Conn, id uint64, peer Peer, kill chan interface{}) {
+		peers <- peer
+		_, _ = conn.Write([]byte("ok"))
+	}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	address := freeAddress(t)
+	l, err := New(zap.NewNop(), sd, "tcp", address, false, handler, func() {}, WithTLS(serverTLS))
+	assert.NoError(t, err)
+	go func() { _ = l.Run() }()
+	defer l.Kill()
+
+	clientPair, err := tls.X509KeyPair(clientCert, clientKey)
+	assert.NoError(t, err)
+	var conn *tls.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = tls.Dial("tcp", address, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientPair}})
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		buf := make([]byte, 2)
+		_, err = conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", string(buf))
+		_ = conn.Close()
+
+		peer := <-peers
+		assert.Equal(t, "client-a", peer.Identity)
+		assert.NotNil(t, peer.Certificate)
+	}
+
+	// clients without a certificate are rejected before reaching the handler
+	conn, err = tls.Dial("tcp", address, &tls.Config{RootCAs: ca.pool})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	assert.Error(t, err)
+	select {
+	case peer := <-peers:
+		assert.Fail(t, "unexpected connection", peer.Address)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,56 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// Peer describes the client on the other end of an accepted connection
+type Peer struct {
+	Address string
+	// Identity is taken from the verified client certificate, and is empty unless client certificates are verified
+	Identity    string
+	Certificate *x509.Certificate
+}
+
+// handshake completes the TLS handshake on TLS connections and returns the peer
+func (l *Listener) handshake(c net.Conn) (Peer, error) {
+	peer := Peer{Address: c.RemoteAddr().String()}
+
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return peer, nil
+	}
+
+	if err := tc.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return peer, err
+	}
+	if err := tc.Handshake(); err != nil {
+		return peer, err
+	}
+	if err := tc.SetDeadline(time.Time{}); err != nil {
+		return peer, err
+	}
+
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		peer.Certificate = state.VerifiedChains[0][0]
+		peer.Identity = certificateIdentity(peer.Certificate)
+	}
+	return peer, nil
+}
+
+// certificateIdentity returns the subject common name of cert, falling back to its first DNS or URI SAN
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"regexp"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -19,7 +19,6 @@ import (
 	"github.com/coinbase/mongobetween/util"
 
 	"github.com/coinbase/memcachedbetween/config"
-	"github.com/coinbase/memcachedbetween/elasticache"
 	"github.com/coinbase/memcachedbetween/handlers"
 	"github.com/coinbase/memcachedbetween/listener"
 	"github.com/coinbase/memcachedbetween/pool"
@@ -29,124 +28,194 @@ const disconnectTimeout = 10 * time.Second
 
 func main() {
 	c := config.ParseFlags()
-	log := newLogger(c.Level, c.Pretty)
-	err := run(log, c)
+	log, level := newLogger(c.Level, c.Pretty)
+	err := run(log, level, c)
 	if err != nil {
 		log.Panic("Error", zap.Error(err))
 	}
 }
 
-func run(log *zap.Logger, cfg *config.Config) error {
+func run(log *zap.Logger, level zap.AtomicLevel, cfg *config.Config) error {
 	sd, err := statsd.New(cfg.Statsd, statsd.WithNamespace("memcachedbetween"))
 	if err != nil {
 		return err
 	}
 
-	nodes, err := elasticache.ClusterNodes(log, cfg.UpstreamConfigHost)
+	upstreamTLS, err := cfg.UpstreamTLS.ClientConfig()
 	if err != nil {
 		return err
 	}
-	log.Info("Config read", zap.Strings("servers", nodes))
 
-	listeners, err := createListeners(log, sd, cfg, nodes)
+	nodes, watch, err := discover(log, cfg, upstreamTLS)
 	if err != nil {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	defer func() {
-		wg.Wait()
-	}()
+	rc := config.NewReloadable(cfg)
+	t, err := newTopology(log, sd, rc, upstreamTLS)
+	if err != nil {
+		return err
+	}
+	defer t.wait()
+
+	if err = t.update(nodes); err != nil {
+		t.shutdown()
+		return err
+	}
 
-	for _, l := range listeners {
-		l := l
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	configListener, err := localConfigListener(log, sd, cfg, t)
+	if err != nil {
+		t.shutdown()
+		return err
+	}
+	t.start(configListener)
 
-			err = l.Run()
-			if err != nil {
-				log.Error("Error", zap.Error(err))
+	stop := make(chan interface{})
+	if watch != nil {
+		go watch(func(nodes []string) {
+			if err := t.update(nodes); err != nil {
+				log.Error("Failed to update local proxies", zap.Error(err))
 			}
-		}()
+		}, stop)
 	}
 
 	shutdown := func() {
-		for _, l := range listeners {
-			l.Shutdown()
-		}
+		close(stop)
+		configListener.Shutdown()
+		t.shutdown()
 	}
 	kill := func() {
-		for _, l := range listeners {
-			l.Kill()
+		configListener.Kill()
+		t.kill()
+	}
+	reload := func() {
+		restart, err := rc.Reload()
+		if err != nil {
+			log.Error("Failed to reload config", zap.Error(err))
+			return
+		}
+		level.SetLevel(rc.Get().Level)
+		t.resize()
+		log.Info("Config reloaded")
+		if len(restart) > 0 {
+			log.Warn("Changed settings need a restart to be applied", zap.Strings("fields", restart))
 		}
 	}
-	shutdownOnSignal(log, shutdown, kill)
+	shutdownOnSignal(log, shutdown, kill, reload)
 
 	log.Info("Running")
 	return nil
 }
 
-func createListeners(log *zap.Logger, sd *statsd.Client, cfg *config.Config, upstreams []string) ([]*listener.Listener, error) {
-	var configs []string
-	var listeners []*listener.Listener
-
-	for index, upstream := range upstreams {
-		var local string
-		if strings.Contains(cfg.Network, "unix") {
-			local = fmt.Sprintf("%s%d%s", cfg.LocalSocketPrefix, index, cfg.LocalSocketSuffix)
-			configs = append(configs, fmt.Sprintf("%s||", local))
-		} else {
-			port := cfg.LocalPortStart + index
-			local = fmt.Sprintf(":%d", port)
-			configs = append(configs, fmt.Sprintf("localhost|127.0.0.1|%d", port))
-		}
+// localConfigListener creates the listener for the elasticache-like config endpoint, which advertises the
+// local proxies of t
+func localConfigListener(log *zap.Logger, sd *statsd.Client, cfg *config.Config, t *topology) (*listener.Listener, error) {
+	connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, peer listener.Peer, kill chan interface{}) {
+		handlers.ConfigConnection(log, conn, kill, &t.configs)
+	}
+	return listener.New(log, sd, "tcp4", cfg.LocalConfigHost, cfg.Unlink, connectionHandler, func() {}, t.listenerOpts...)
+}
 
-		logWith := log.With(zap.String("upstream", upstream), zap.String("local", local))
-		sdWith, err := util.StatsdWithTags(sd, []string{fmt.Sprintf("upstream:%s", upstream), fmt.Sprintf("local:%s", local)})
-		if err != nil {
-			return nil, err
-		}
+// localAddress returns the address of the local proxy with the given index, and its entry in the local config
+func localAddress(cfg *config.Config, index int) (string, string) {
+	if strings.Contains(cfg.Network, "unix") {
+		local := fmt.Sprintf("%s%d%s", cfg.LocalSocketPrefix, index, cfg.LocalSocketSuffix)
+		return local, fmt.Sprintf("%s||", local)
+	}
+	port := cfg.LocalPortStart + index
+	return fmt.Sprintf(":%d", port), fmt.Sprintf("localhost|127.0.0.1|%d", port)
+}
 
-		m, err := pool.ConnectServer(
-			pool.Address(upstream),
-			pool.WithMinConnections(func(uint64) uint64 { return cfg.MinPoolSize }),
-			pool.WithMaxConnections(func(uint64) uint64 { return cfg.MaxPoolSize }),
-			pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return poolMonitor(sdWith) }),
-		)
-		if err != nil {
-			return nil, err
-		}
+func connectServer(rc *config.Reloadable, sd *statsd.Client, upstreamTLS *tls.Config, upstream string) (*pool.Server, error) {
+	cfg := rc.Get()
+	u := cfg.Upstream(upstream)
+	return pool.ConnectServer(
+		pool.Address(upstream),
+		pool.WithMinConnections(func(uint64) uint64 { return u.MinPoolSize }),
+		pool.WithMaxConnections(func(uint64) uint64 { return u.MaxPoolSize }),
+		pool.WithHealthCheckInterval(func(time.Duration) time.Duration { return cfg.HealthCheckInterval }),
+		pool.WithHealthCheckTimeout(func(time.Duration) time.Duration { return cfg.HealthCheckTimeout }),
+		pool.WithMaxLifetime(func(time.Duration) time.Duration { return cfg.ConnLifetime }),
+		pool.WithLifetimeJitter(func(time.Duration) time.Duration { return cfg.ConnLifetimeJitter }),
+		pool.WithMaxRequests(func(uint64) uint64 { return cfg.ConnMaxRequests }),
+		pool.WithDialLimits(func(pool.DialConfig) pool.DialConfig {
+			return pool.DialConfig{
+				MaxConcurrent: cfg.MaxDials,
+				Backoff:       cfg.DialBackoff,
+				MaxBackoff:    cfg.MaxDialBackoff,
+			}
+		}),
+		pool.WithClearOn(func(pool.ErrorClass) pool.ErrorClass {
+			var classes pool.ErrorClass
+			for _, class := range cfg.ClearOn {
+				classes |= clearOnClasses[class]
+			}
+			return classes
+		}),
+		pool.WithCircuitBreaker(func(pool.BreakerConfig) pool.BreakerConfig {
+			return pool.BreakerConfig{
+				Failures:    cfg.BreakerFailures,
+				FailureRate: cfg.BreakerFailureRate,
+				MinRequests: cfg.BreakerMinRequests,
+				Window:      cfg.BreakerWindow,
+				OpenTimeout: cfg.BreakerOpenTimeout,
+			}
+		}),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return poolMonitor(sd, rc) }),
+		pool.WithConnectionOptions(func(opts ...pool.ConnectionOption) []pool.ConnectionOption {
+			return append(opts, connectionOptions(cfg, upstreamTLS)...)
+		}),
+	)
+}
 
-		connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
-			handlers.CommandConnection(log, sd, cfg, conn, local, id, m, kill)
-		}
-		shutdownHandler := func() {
-			ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
-			defer cancel()
+// commandListener creates a listener on local that proxies commands to the servers picked by route, and commands
+// that concern every server, like flush_all, to all of the servers returned by servers. Those are disconnected on
+// shutdown.
+func commandListener(log *zap.Logger, sd *statsd.Client, sdWith *statsd.Client, rc *config.Reloadable, local string, route handlers.Router, servers func() []*pool.Server, opts []listener.Option) (*listener.Listener, error) {
+	connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, peer listener.Peer, kill chan interface{}) {
+		handlers.CommandConnection(log, sd, rc, conn, local, id, peer.Identity, route, servers, kill)
+	}
+	shutdownHandler := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		for _, m := range servers() {
 			_ = m.Disconnect(ctx)
 		}
-		l, err := listener.New(logWith, sdWith, cfg.Network, local, cfg.Unlink, connectionHandler, shutdownHandler)
-		if err != nil {
-			return nil, err
-		}
-		listeners = append(listeners, l)
 	}
+	cfg := rc.Get()
+	return listener.New(log, sdWith, cfg.Network, local, cfg.Unlink, connectionHandler, shutdownHandler, opts...)
+}
 
-	configsJoined := strings.Join(configs, " ")
-	connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
-		handlers.ConfigConnection(log, conn, kill, configsJoined)
+func connectionOptions(cfg *config.Config, upstreamTLS *tls.Config) []pool.ConnectionOption {
+	var opts []pool.ConnectionOption
+	if upstreamTLS != nil {
+		opts = append(opts, pool.WithDialer(func(dialer pool.Dialer) pool.Dialer {
+			return pool.NewTLSDialer(dialer, upstreamTLS)
+		}))
 	}
-	l, err := listener.New(log, sd, "tcp4", cfg.LocalConfigHost, cfg.Unlink, connectionHandler, func() {})
-	if err != nil {
-		return nil, err
+	if cfg.SASLFile != "" {
+		opts = append(opts, pool.WithSASLPlain(pool.FileCredentials(cfg.SASLFile)))
+	} else if cfg.SASLUsername != "" {
+		opts = append(opts, pool.WithSASLPlain(pool.StaticCredentials(cfg.SASLUsername, cfg.SASLPassword)))
 	}
-	listeners = append(listeners, l)
+	return opts
+}
 
-	return listeners, nil
+// clearOnClasses are the pool error classes of the clearon config values
+var clearOnClasses = map[string]pool.ErrorClass{
+	"connect": pool.ConnectErrors,
+	"network": pool.NetworkErrors,
+	"timeout": pool.Timeouts,
 }
 
-func poolMonitor(sd *statsd.Client) *pool.Monitor {
+// breakerStates are the values of the circuit breaker state gauge
+var breakerStates = map[string]float64{
+	pool.CircuitClosed:   0,
+	pool.CircuitHalfOpen: 1,
+	pool.CircuitOpened:   2,
+}
+
+func poolMonitor(sd *statsd.Client, rc *config.Reloadable) *pool.Monitor {
 	checkedOut, checkedIn := util.StatsdBackgroundGauge(sd, "pool.checked_out_connections", []string{})
 	opened, closed := util.StatsdBackgroundGauge(sd, "pool.open_connections", []string{})
 
@@ -158,6 +227,7 @@ func poolMonitor(sd *statsd.Client) *pool.Monitor {
 				fmt.Sprintf("address:%s", e.Address),
 				fmt.Sprintf("reason:%s", e.Reason),
 			}
+			tags = append(tags, rc.Get().StatsdTags...)
 			switch e.Type {
 			case pool.ConnectionCreated:
 				opened(name, tags)
@@ -167,6 +237,9 @@ func poolMonitor(sd *statsd.Client) *pool.Monitor {
 				checkedOut(name, tags)
 			case pool.ConnectionReturned:
 				checkedIn(name, tags)
+			case pool.CircuitClosed, pool.CircuitHalfOpen, pool.CircuitOpened:
+				_ = sd.Incr(name, tags, 1)
+				_ = sd.Gauge("pool.circuit_breaker_state", breakerStates[e.Type], tags, 1)
 			default:
 				_ = sd.Incr(name, tags, 1)
 			}
@@ -174,7 +247,7 @@ func poolMonitor(sd *statsd.Client) *pool.Monitor {
 	}
 }
 
-func newLogger(level zapcore.Level, pretty bool) *zap.Logger {
+func newLogger(level zapcore.Level, pretty bool) (*zap.Logger, zap.AtomicLevel) {
 	var c zap.Config
 	if pretty {
 		c = zap.NewDevelopmentConfig()
@@ -192,18 +265,23 @@ func newLogger(level zapcore.Level, pretty bool) *zap.Logger {
 		os.Exit(1)
 	}
 
-	return log
+	return log, c.Level
 }
 
-func shutdownOnSignal(log *zap.Logger, shutdownFunc func(), killFunc func()) {
+func shutdownOnSignal(log *zap.Logger, shutdownFunc func(), killFunc func(), reloadFunc func()) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
 		shutdownAttempted := false
 		for sig := range c {
 			log.Info("Signal", zap.String("signal", sig.String()))
 
+			if sig == syscall.SIGHUP {
+				reloadFunc()
+				continue
+			}
+
 			if !shutdownAttempted {
 				log.Info("Shutting down")
 				go shutdownFunc()
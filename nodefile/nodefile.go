@@ -0,0 +1,120 @@
+package nodefile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// settleDelay is how long Watch waits after a change to the file for further changes, so a file that is being
+// written is read once it is complete
+const settleDelay = 100 * time.Millisecond
+
+// Read returns the node addresses listed in the file at path. Files with a .json extension contain an array of
+// addresses, other files list addresses separated by whitespace, with comments starting with #. A file without
+// any nodes is an error, so a file that is being rewritten doesn't remove every node.
+func Read(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		if err = json.Unmarshal(b, &nodes); err != nil {
+			return nil, fmt.Errorf("invalid node file %s: %v", path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			nodes = append(nodes, strings.Fields(line)...)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in %s", path)
+	}
+	return nodes, nil
+}
+
+// Watch reads the file at path again whenever it changes, until stop is closed, and calls read with the nodes every
+// time. Changes are noticed with inotify where it is available, and by polling every interval. Errors reading the
+// file are logged and skipped.
+func Watch(l *zap.Logger, path string, interval time.Duration, read func([]string), stop chan interface{}) {
+	var events chan fsnotify.Event
+	watcher, err := watch(path)
+	if err != nil {
+		l.Warn("Failed to watch node file, polling it instead", zap.String("path", path), zap.Error(err))
+	} else {
+		defer func() {
+			_ = watcher.Close()
+		}()
+		events = watcher.Events
+	}
+
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	settle := time.NewTimer(settleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case e := <-events:
+			if filepath.Clean(e.Name) == filepath.Clean(path) {
+				settle.Reset(settleDelay)
+			}
+			continue
+		case <-settle.C:
+		case <-poll:
+		}
+
+		nodes, err := Read(path)
+		if err != nil {
+			l.Warn("Failed to read node file", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		l.Debug("Node file read", zap.String("path", path), zap.Strings("servers", nodes))
+		read(nodes)
+	}
+}
+
+// watch watches the directory of path, so the file is still watched after it is replaced by a rename
+func watch(path string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go func() {
+		// errors are only informational, changes are still picked up by polling
+		for range watcher.Errors {
+		}
+	}()
+	return watcher, nil
+}
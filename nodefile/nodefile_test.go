@@ -0,0 +1,83 @@
+package nodefile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// writeFile writes contents to a file called name in dir, replacing it with a rename like orchestration tools do
+func writeFile(t *testing.T, dir, name, contents string) string {
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte(contents), 0600))
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.Rename(tmp, path))
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "memcachedbetween")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestRead(t *testing.T) {
+	dir := tempDir(t)
+
+	nodes, err := Read(writeFile(t, dir, "nodes", "# cache nodes\na:11211 b:11211\n\nc:11211 # new\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:11211", "b:11211", "c:11211"}, nodes)
+
+	nodes, err = Read(writeFile(t, dir, "nodes.json", `["a:11211", "b:11211"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:11211", "b:11211"}, nodes)
+
+	_, err = Read(writeFile(t, dir, "nodes.json", `{"a": 1}`))
+	assert.Error(t, err)
+	_, err = Read(writeFile(t, dir, "nodes", "# none\n"))
+	assert.Error(t, err)
+	_, err = Read(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	dir := tempDir(t)
+	path := writeFile(t, dir, "nodes", "a:11211\n")
+	changes := make(chan []string, 10)
+	stop := make(chan interface{})
+	defer close(stop)
+	go Watch(zap.NewNop(), path, 0, func(nodes []string) {
+		changes <- nodes
+	}, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	writeFile(t, dir, "other", "c:11211\n")
+	writeFile(t, dir, "nodes", "a:11211\nb:11211\n")
+	assert.Equal(t, []string{"a:11211", "b:11211"}, nextChange(t, changes, []string{"a:11211"}))
+
+	// an empty file keeps the last nodes
+	writeFile(t, dir, "nodes", "")
+	writeFile(t, dir, "nodes", "b:11211\n")
+	assert.Equal(t, []string{"b:11211"}, nextChange(t, changes, []string{"a:11211", "b:11211"}))
+}
+
+// nextChange returns the first nodes read that differ from last
+func nextChange(t *testing.T, changes chan []string, last []string) []string {
+	for {
+		select {
+		case nodes := <-changes:
+			if !assert.ObjectsAreEqual(last, nodes) {
+				return nodes
+			}
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "nodes didn't change")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of a connection while the server's circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerConfig configures the circuit breaker of a server. The breaker opens when either of the limits that are
+// set is reached, and is disabled when neither is set.
+type BreakerConfig struct {
+	Failures    int           // consecutive failures that open the breaker
+	FailureRate float64       // share of failed requests within Window that opens the breaker, from 0 to 1
+	MinRequests int           // requests needed within Window before FailureRate applies
+	Window      time.Duration // how long requests are counted for FailureRate
+	OpenTimeout time.Duration // how long the breaker stays open before a request is let through to probe the server
+}
+
+// enabled returns true if either of the limits is set
+func (bc BreakerConfig) enabled() bool {
+	return bc.Failures > 0 || bc.FailureRate > 0
+}
+
+// breaker states
+const (
+	breakerClosed int = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// breaker is a circuit breaker. While it is closed, requests are let through and their outcomes counted. Once
+// it opens, requests fail fast until OpenTimeout has passed, when it half-opens and lets a single probe request
+// through. The breaker closes if the probe succeeds, and opens again if it fails.
+type breaker struct {
+	cfg      BreakerConfig
+	onChange func(state int)
+
+	mu          sync.Mutex
+	state       int
+	consecutive int       // failures in a row
+	requests    int       // requests in the current window
+	failures    int       // failures in the current window
+	windowStart time.Time // start of the current window
+	changed     time.Time // when the state last changed, or the probe was let through when half open
+	probing     bool
+}
+
+func newBreaker(cfg BreakerConfig, onChange func(state int)) *breaker {
+	return &breaker{cfg: cfg, onChange: onChange, windowStart: time.Now()}
+}
+
+// allow returns true if a request can be made. Every allowed request must be followed by a call to done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.changed) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		// a probe that was never reported doesn't keep the breaker half open forever
+		if b.probing && time.Since(b.changed) < b.cfg.OpenTimeout {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	b.changed = time.Now()
+	return true
+}
+
+// done records the outcome of an allowed request. Requests that neither succeeded nor failed because of the
+// server, such as those that timed out waiting for a connection, are recorded with counted false.
+func (b *breaker) done(counted bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		switch {
+		case !counted:
+		case failed:
+			b.setState(breakerOpen)
+		default:
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	if !counted || b.state != breakerClosed {
+		return
+	}
+
+	if time.Since(b.windowStart) >= b.cfg.Window {
+		b.windowStart = time.Now()
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	switch {
+	case b.cfg.Failures > 0 && b.consecutive >= b.cfg.Failures:
+		b.setState(breakerOpen)
+	case b.cfg.FailureRate > 0 && b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.FailureRate:
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state and resets the counts. Requires that the breaker be locked.
+func (b *breaker) setState(state int) {
+	b.state = state
+	b.changed = time.Now()
+	b.probing = false
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.windowStart = b.changed
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
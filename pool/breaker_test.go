@@ -0,0 +1,56 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerFailures(t *testing.T) {
+	var states []int
+	b := newBreaker(BreakerConfig{Failures: 2, OpenTimeout: 20 * time.Millisecond}, func(state int) {
+		states = append(states, state)
+	})
+
+	assert.True(t, b.allow())
+	b.done(true, true)
+	assert.True(t, b.allow())
+	b.done(true, false) // a success resets the consecutive failures
+	assert.True(t, b.allow())
+	b.done(true, true)
+	assert.True(t, b.allow())
+	b.done(false, true) // uncounted outcomes are ignored
+	assert.True(t, b.allow())
+	b.done(true, true)
+	assert.Equal(t, []int{breakerOpen}, states)
+	assert.False(t, b.allow())
+
+	// a single probe is let through once the breaker half opens, and a failed probe opens it again
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.done(true, true)
+	assert.Equal(t, []int{breakerOpen, breakerHalfOpen, breakerOpen}, states)
+	assert.False(t, b.allow())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.done(true, false)
+	assert.Equal(t, []int{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}, states)
+	assert.True(t, b.allow())
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	b := newBreaker(BreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, OpenTimeout: time.Minute}, nil)
+
+	for _, failed := range []bool{true, false, true} {
+		assert.True(t, b.allow())
+		b.done(true, failed)
+	}
+	assert.True(t, b.allow())
+	b.done(true, false)
+	assert.True(t, b.allow())
+	b.done(true, true) // 3 of 5 failed
+	assert.False(t, b.allow())
+}
@@ -0,0 +1,52 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ErrorClass is a set of classes of errors on a server's connections, used to pick the errors that clear its pool
+type ErrorClass uint
+
+// error classes
+const (
+	ConnectErrors ErrorClass = 1 << iota // dialing or handshaking a new connection failed
+	NetworkErrors                        // a connection was closed or reset, or failed otherwise
+	Timeouts                             // reading or writing a connection timed out
+)
+
+// classify returns the class of err from reading or writing a connection, or 0 if it isn't a connection error.
+// Errors from requests that were cancelled by the client don't say anything about the server.
+func classify(err error) ErrorClass {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Timeouts
+	}
+	var connErr ConnectionError
+	if errors.As(err, &connErr) || errors.Is(err, io.EOF) {
+		return NetworkErrors
+	}
+	return 0
+}
+
+// clear bumps the generation of the pool, so that the connections made before are closed instead of being reused:
+// idle ones right away, and checked out ones when they are returned.
+func (p *pool) clear() {
+	if atomic.LoadInt32(&p.connected) != connected {
+		return
+	}
+	atomic.AddUint64(&p.generation, 1)
+	if p.monitor != nil {
+		p.monitor.Event(&Event{
+			Type:    Cleared,
+			Address: p.address.String(),
+		})
+	}
+	p.conns.Maintain()
+}
@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, ErrorClass(0), classify(nil))
+	assert.Equal(t, ErrorClass(0), classify(context.Canceled))
+	assert.Equal(t, ErrorClass(0), classify(ConnectionError{Wrapped: context.Canceled}))
+	assert.Equal(t, ErrorClass(0), classify(errors.New("unknown opcode")))
+	assert.Equal(t, NetworkErrors, classify(io.EOF))
+	assert.Equal(t, NetworkErrors, classify(ConnectionError{Wrapped: errors.New("connection reset by peer")}))
+	assert.Equal(t, Timeouts, classify(ConnectionError{Wrapped: timeoutError{}}))
+}
+
+func TestClear(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var cleared int
+	s, err := ConnectServer(Address(l.Addr().String()),
+		WithClearOn(func(ErrorClass) ErrorClass { return NetworkErrors }),
+		WithConnectionPoolMonitor(func(*Monitor) *Monitor {
+			return &Monitor{Event: func(e *Event) {
+				if e.Type == Cleared {
+					mu.Lock()
+					defer mu.Unlock()
+					cleared++
+				}
+			}}
+		}),
+	)
+	assert.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+
+	var conns []ConnectionWrapper
+	for i := 0; i < 3; i++ {
+		conn, err := s.Connection(context.Background())
+		assert.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	idle := conns[0]
+	assert.NoError(t, idle.Return())
+
+	// timeouts aren't configured to clear
+	s.Report(conns[1], ConnectionError{Wrapped: timeoutError{}})
+	assert.Equal(t, uint64(0), s.Stats().Generation)
+
+	s.Report(conns[1], io.EOF)
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.Generation)
+	assert.Equal(t, 0, stats.Idle)
+	assert.Equal(t, 2, stats.Opened)
+
+	// the error of a connection made before the clear doesn't clear the pool again
+	s.Report(conns[2], io.EOF)
+	assert.Equal(t, uint64(1), s.Stats().Generation)
+
+	// checked out connections are closed when they are returned
+	assert.NoError(t, conns[1].Return())
+	assert.NoError(t, conns[2].Return())
+	stats = s.Stats()
+	assert.Equal(t, 0, stats.Opened)
+	assert.Equal(t, uint64(3), stats.Closed)
+
+	conn, err := s.Connection(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Return())
+	assert.Equal(t, 1, s.Stats().Idle)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, cleared)
+}
+
+func TestClearOnConnectError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = l.Close()
+
+	s, err := ConnectServer(Address(l.Addr().String()),
+		WithClearOn(func(ErrorClass) ErrorClass { return ConnectErrors }),
+	)
+	assert.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+
+	_, err = s.Connection(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), s.Stats().Generation)
+}
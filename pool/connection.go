@@ -30,6 +30,10 @@ type connection struct {
 	connectContextMade   chan struct{}
 	connectContextMutex  sync.Mutex
 	expiresAfter         time.Time // the time until when this connection can stay idle
+	returned             time.Time // when this connection was last returned to the pool
+	healthCheckFailed    bool      // set when this connection failed a health check while it was idle
+	closesAt             time.Time // when this connection is closed regardless of use, if set
+	requests             uint64    // how many times this connection has been checked out and returned
 
 	// pool related fields
 	pool         *pool
@@ -63,7 +67,11 @@ func (c *connection) processInitializationError(err error) {
 		_ = c.nc.Close()
 	}
 
-	c.connectErr = ConnectionError{Address: c.addr.String(), ID: c.id, Wrapped: err}
+	var message string
+	if IsAuthenticationError(err) {
+		message = "authentication failed"
+	}
+	c.connectErr = ConnectionError{Address: c.addr.String(), ID: c.id, Wrapped: err, Message: message}
 	if c.config.errorHandlingCallback != nil {
 		c.config.errorHandlingCallback(c.connectErr)
 	}
@@ -96,6 +104,27 @@ func (c *connection) connect(ctx context.Context) {
 
 	close(c.connectContextMade)
 
+	if c.pool != nil && c.pool.dials != nil {
+		// Errors from the gate aren't connection errors, because the server wasn't dialed.
+		if err := c.pool.dials.start(ctx); err != nil {
+			atomic.StoreInt32(&c.connected, disconnected)
+			c.connectErr = err
+			return
+		}
+		parent := ctx
+		defer func() {
+			c.pool.dials.done(c.connectErr, parent.Err() == nil)
+		}()
+	}
+
+	// Bound the dial and any handshakes by the connect timeout, as dialers such as the TLS dialer do more
+	// than open a socket.
+	if c.config.connectTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.connectTimeout)
+		defer cancel()
+	}
+
 	// Assign the result of DialContext to a temporary net.Conn to ensure that c.nc is not set in an error case.
 	var err error
 	var tempNc net.Conn
@@ -104,9 +133,34 @@ func (c *connection) connect(ctx context.Context) {
 		c.processInitializationError(err)
 		return
 	}
+
+	if c.config.handshaker != nil {
+		err = c.handshake(ctx, tempNc)
+		if err != nil {
+			_ = tempNc.Close()
+			c.processInitializationError(err)
+			return
+		}
+	}
 	c.nc = tempNc
 }
 
+// handshake runs the configured handshaker on nc, bounded by the deadline of ctx
+func (c *connection) handshake(ctx context.Context, nc net.Conn) error {
+	if dl, ok := ctx.Deadline(); ok {
+		if err := nc.SetDeadline(dl); err != nil {
+			return err
+		}
+	}
+
+	err := c.config.handshaker.Handshake(ctx, c.addr, nc)
+	if err != nil {
+		return err
+	}
+
+	return nc.SetDeadline(time.Time{})
+}
+
 func (c *connection) wait() error {
 	if c.connectDone != nil {
 		<-c.connectDone
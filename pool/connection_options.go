@@ -19,9 +19,23 @@ func (df DialerFunc) DialContext(ctx context.Context, network, address string) (
 	return df(ctx, network, address)
 }
 
+// Handshaker initializes a connection after it has been dialed, for example by authenticating it.
+type Handshaker interface {
+	Handshake(ctx context.Context, address Address, nc net.Conn) error
+}
+
+// HandshakerFunc is a type implemented by functions that can be used as a Handshaker.
+type HandshakerFunc func(ctx context.Context, address Address, nc net.Conn) error
+
+// Handshake implements the Handshaker interface.
+func (hf HandshakerFunc) Handshake(ctx context.Context, address Address, nc net.Conn) error {
+	return hf(ctx, address, nc)
+}
+
 type connectionConfig struct {
 	connectTimeout        time.Duration
 	dialer                Dialer
+	handshaker            Handshaker
 	cmdMonitor            *CommandMonitor
 	errorHandlingCallback func(error)
 }
@@ -73,6 +87,23 @@ func WithDialer(fn func(Dialer) Dialer) ConnectionOption {
 	}
 }
 
+// WithHandshaker configures the Handshaker that initializes new connections after they are dialed. The
+// handshake must complete before the connection is checked out of the pool.
+func WithHandshaker(fn func(Handshaker) Handshaker) ConnectionOption {
+	return func(c *connectionConfig) error {
+		c.handshaker = fn(c.handshaker)
+		return nil
+	}
+}
+
+// WithSASLPlain configures new connections to authenticate with the SASL PLAIN mechanism, using the
+// credentials returned by credentials at the time each connection is made.
+func WithSASLPlain(credentials CredentialsFunc) ConnectionOption {
+	return WithHandshaker(func(Handshaker) Handshaker {
+		return saslPlainHandshaker(credentials)
+	})
+}
+
 // WithMonitor configures a event for command monitoring.
 func WithMonitor(fn func(*CommandMonitor) *CommandMonitor) ConnectionOption {
 	return func(c *connectionConfig) error {
@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrBackingOff is returned instead of a new connection while dials to the server back off after failing
+var ErrBackingOff = errors.New("backing off after failing to connect")
+
+// DialConfig configures how connections to a server are dialed. Dials aren't limited and don't back off unless
+// the limits are set.
+type DialConfig struct {
+	MaxConcurrent int           // dials that can be in progress at once
+	Backoff       time.Duration // how long new connections fail fast after a dial failed, doubled for every failure in a row
+	MaxBackoff    time.Duration // the longest backoff, unlimited if 0
+}
+
+// dialGate limits the dials in progress to a server, and backs off after they fail. Backoffs are jittered so that
+// proxies that lost a server at the same time don't all dial it again at once.
+type dialGate struct {
+	cfg   DialConfig
+	sem   *limiter // nil if dials aren't limited
+	event func(e *Event)
+
+	mu       sync.Mutex
+	failures int       // failed dials in a row
+	until    time.Time // end of the current backoff
+}
+
+func newDialGate(cfg DialConfig, event func(e *Event)) *dialGate {
+	g := &dialGate{cfg: cfg, event: event}
+	if cfg.MaxConcurrent > 0 {
+		g.sem = newLimiter(int64(cfg.MaxConcurrent))
+	}
+	return g
+}
+
+// backingOff returns true while new connections should fail fast
+func (g *dialGate) backingOff() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Now().Before(g.until)
+}
+
+// start waits until a dial can be made, or returns ErrBackingOff if dials are backing off. Every successful call
+// must be followed by a call to done.
+func (g *dialGate) start(ctx context.Context) error {
+	if g.backingOff() {
+		return ErrBackingOff
+	}
+	if g.sem != nil {
+		if err := g.sem.Acquire(ctx); err != nil {
+			return err
+		}
+	}
+	g.event(&Event{Type: DialStarted})
+	return nil
+}
+
+// done records the outcome of a dial, which backs off if it failed. Dials that were cancelled by the caller rather
+// than failed by the server are recorded with counted false.
+func (g *dialGate) done(err error, counted bool) {
+	if g.sem != nil {
+		g.sem.Release()
+	}
+	if err == nil {
+		g.mu.Lock()
+		backedOff := g.failures > 0
+		g.failures = 0
+		g.until = time.Time{}
+		g.mu.Unlock()
+
+		g.event(&Event{Type: DialSucceeded})
+		if backedOff {
+			g.event(&Event{Type: BackoffEnded})
+		}
+		return
+	}
+
+	g.event(&Event{Type: DialFailed, Reason: connectErrorReason(err)})
+	if !counted || g.cfg.Backoff <= 0 {
+		return
+	}
+
+	g.mu.Lock()
+	g.failures++
+	backoff := g.backoff(g.failures)
+	g.until = time.Now().Add(backoff)
+	g.mu.Unlock()
+
+	g.event(&Event{Type: BackoffStarted, Duration: backoff})
+}
+
+// backoff returns how long to back off after the given number of failed dials in a row. It is picked at random
+// from the upper half of the exponential backoff.
+func (g *dialGate) backoff(failures int) time.Duration {
+	backoff := g.cfg.Backoff
+	for i := 1; i < failures && (g.cfg.MaxBackoff <= 0 || backoff < g.cfg.MaxBackoff) && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if g.cfg.MaxBackoff > 0 && backoff > g.cfg.MaxBackoff {
+		backoff = g.cfg.MaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,111 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialGateBackoff(t *testing.T) {
+	var events []string
+	g := newDialGate(DialConfig{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}, func(e *Event) {
+		events = append(events, e.Type)
+	})
+
+	for _, tc := range []struct {
+		failures int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			backoff := g.backoff(tc.failures)
+			assert.True(t, backoff >= tc.min && backoff <= tc.max, "%d failures: %v", tc.failures, backoff)
+		}
+	}
+
+	assert.NoError(t, g.start(context.Background()))
+	g.done(errors.New("refused"), true)
+	assert.True(t, g.backingOff())
+	assert.Equal(t, ErrBackingOff, g.start(context.Background()))
+
+	// a dial that succeeds ends the backoff
+	g.until = time.Now()
+	assert.NoError(t, g.start(context.Background()))
+	g.done(nil, true)
+	assert.False(t, g.backingOff())
+	assert.Equal(t, []string{DialStarted, DialFailed, BackoffStarted, DialStarted, DialSucceeded, BackoffEnded}, events)
+
+	// cancelled dials don't back off
+	assert.NoError(t, g.start(context.Background()))
+	g.done(context.Canceled, false)
+	assert.False(t, g.backingOff())
+}
+
+func TestDialGateConcurrency(t *testing.T) {
+	g := newDialGate(DialConfig{MaxConcurrent: 1}, func(*Event) {})
+	assert.NoError(t, g.start(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, g.start(ctx))
+
+	g.done(nil, true)
+	assert.NoError(t, g.start(context.Background()))
+}
+
+func TestDialBackoffFailsFast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = l.Close()
+
+	var mu sync.Mutex
+	var events []*Event
+	s, err := ConnectServer(Address(l.Addr().String()),
+		WithDialLimits(func(DialConfig) DialConfig {
+			return DialConfig{MaxConcurrent: 1, Backoff: time.Minute}
+		}),
+		WithConnectionPoolMonitor(func(*Monitor) *Monitor {
+			return &Monitor{Event: func(e *Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, e)
+			}}
+		}),
+	)
+	assert.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+
+	_, err = s.Connection(context.Background())
+	var connErr ConnectionError
+	assert.True(t, errors.As(err, &connErr), err)
+
+	start := time.Now()
+	_, err = s.Connection(context.Background())
+	assert.Equal(t, ErrBackingOff, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var backoff *Event
+	for _, e := range events {
+		if e.Type == BackoffStarted {
+			backoff = e
+		}
+	}
+	if assert.NotNil(t, backoff) {
+		assert.True(t, backoff.Duration >= 30*time.Second)
+	}
+	last := events[len(events)-1]
+	assert.Equal(t, GetFailed, last.Type)
+	assert.Equal(t, ReasonBackingOff, last.Reason)
+}
@@ -17,3 +17,8 @@ func (e ConnectionError) Error() string {
 	}
 	return fmt.Sprintf("connection(%s[%d]) %s", e.Address, e.ID, e.Message)
 }
+
+// Unwrap returns the underlying error.
+func (e ConnectionError) Unwrap() error {
+	return e.Wrapped
+}
@@ -0,0 +1,112 @@
+package pool
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// defaultHealthCheckTimeout is how long an idle connection has to answer a health check, unless configured
+var defaultHealthCheckTimeout = time.Second
+
+// healthCheckLoop checks the idle connections every interval until done is closed
+func (p *pool) healthCheckLoop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		p.checkIdle(interval)
+	}
+}
+
+// checkIdle takes the connections that have been idle for at least idle out of the pool, and sends each a noop.
+// Connections that answer in time are put back, and the others are closed.
+func (p *pool) checkIdle(idle time.Duration) {
+	conns := p.conns.take(func(v interface{}) bool {
+		c, ok := v.(*connection)
+		return ok && c.established() && time.Since(c.returned) >= idle
+	})
+
+	var wg sync.WaitGroup
+	for _, v := range conns {
+		c := v.(*connection)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := noop(c.nc, p.healthCheckTimeout)
+			event := &Event{
+				Type:         HealthCheckSucceeded,
+				Address:      p.address.String(),
+				ConnectionID: c.poolID,
+			}
+			if err != nil {
+				event.Type = HealthCheckFailed
+				event.Reason = err.Error()
+				c.healthCheckFailed = true
+				_ = c.close()
+			} else {
+				c.returned = time.Now()
+			}
+			if p.monitor != nil {
+				p.monitor.Event(event)
+			}
+			// unhealthy connections are closed and counted out of the pool by its expiredFn
+			_ = p.conns.Put(c)
+		}()
+	}
+	wg.Wait()
+}
+
+// established returns true if c has finished connecting without an error. It doesn't block.
+func (c *connection) established() bool {
+	select {
+	case <-c.connectDone:
+		return c.connectErr == nil && atomic.LoadInt32(&c.connected) == connected
+	default:
+		return false
+	}
+}
+
+// noop sends a binary noop on nc, and waits until timeout for the response
+func noop(nc net.Conn, timeout time.Duration) error {
+	if err := nc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	req := protocol.NewRequest(protocol.OpNoop, 0, nil, nil, nil)
+	if _, err := nc.Write(req.Encode()); err != nil {
+		return err
+	}
+
+	var headerBuf [protocol.HeaderLen]byte
+	if _, err := io.ReadFull(nc, headerBuf[:]); err != nil {
+		return err
+	}
+	h, _ := protocol.DecodeHeader(headerBuf[:])
+	if h.Magic != protocol.MagicResponse || h.Opcode != protocol.OpNoop {
+		return fmt.Errorf("unexpected noop response for %s with magic 0x%02x", h.Opcode, h.Magic)
+	}
+	if herr := h.Validate(0); herr != nil {
+		return herr
+	}
+	if _, err := io.CopyN(ioutil.Discard, nc, int64(h.BodyLength)); err != nil {
+		return err
+	}
+	if h.Status != protocol.StatusNoError {
+		return fmt.Errorf("noop failed with status %s", h.Status)
+	}
+
+	return nc.SetDeadline(time.Time{})
+}
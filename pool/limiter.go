@@ -0,0 +1,86 @@
+package pool
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter is a counting semaphore whose size can be changed while it is in use. When it shrinks, acquisitions
+// wait until enough units have been released to get under the new size.
+type limiter struct {
+	mu      sync.Mutex
+	size    int64
+	used    int64
+	waiting int64         // acquisitions blocked until a unit is available
+	changed chan struct{} // closed and replaced whenever a unit is released or the size changes
+}
+
+func newLimiter(size int64) *limiter {
+	return &limiter{size: size, changed: make(chan struct{})}
+}
+
+// Acquire acquires a unit, blocking until one is available or ctx is done
+func (l *limiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.used < l.size {
+			l.used++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.waiting++
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		}
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquire acquires a unit if one is available without blocking, and reports whether it did
+func (l *limiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.used < l.size {
+		l.used++
+		return true
+	}
+	return false
+}
+
+// Release releases a unit
+func (l *limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used--
+	l.notify()
+}
+
+// Waiting returns how many acquisitions are blocked until a unit is available
+func (l *limiter) Waiting() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+// Resize changes the number of units that can be acquired at once
+func (l *limiter) Resize(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.size = size
+	l.notify()
+}
+
+// notify wakes up waiting acquisitions. Requires that the limiter be locked.
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -8,6 +8,7 @@ package pool
 
 import (
 	"context"
+	"time"
 )
 
 // CommandStartedEvent represents an event generated when a command is sent to a server.
@@ -48,11 +49,17 @@ type CommandMonitor struct {
 
 // strings for pool command monitoring reasons
 const (
-	ReasonPoolClosed        = "poolClosed"
-	ReasonStale             = "stale"
-	ReasonConnectionErrored = "connectionError"
-	ReasonTimedOut          = "timeout"
-	ReasonConnectionExpired = "old"
+	ReasonPoolClosed           = "poolClosed"
+	ReasonStale                = "stale"
+	ReasonConnectionErrored    = "connectionError"
+	ReasonTimedOut             = "timeout"
+	ReasonConnectionExpired    = "old"
+	ReasonAuthenticationFailed = "authenticationFailed"
+	ReasonHealthCheckFailed    = "healthCheckFailed"
+	ReasonCircuitOpen          = "circuitOpen"
+	ReasonLifetimeExceeded     = "lifetimeExceeded"
+	ReasonMaxRequests          = "maxRequests"
+	ReasonBackingOff           = "backingOff"
 )
 
 // strings for pool command monitoring types
@@ -65,8 +72,29 @@ const (
 	ConnectionReturned = "ConnectionCheckedIn"
 	Cleared            = "ConnectionPoolCleared"
 	Closed             = "ConnectionPoolClosed"
+	Resized            = "ConnectionPoolResized"
+
+	HealthCheckSucceeded = "ConnectionHealthCheckSucceeded"
+	HealthCheckFailed    = "ConnectionHealthCheckFailed"
+
+	CircuitClosed   = "CircuitBreakerClosed"
+	CircuitHalfOpen = "CircuitBreakerHalfOpen"
+	CircuitOpened   = "CircuitBreakerOpened"
+
+	DialStarted    = "ConnectionDialStarted"
+	DialSucceeded  = "ConnectionDialSucceeded"
+	DialFailed     = "ConnectionDialFailed"
+	BackoffStarted = "ConnectionDialBackoffStarted"
+	BackoffEnded   = "ConnectionDialBackoffEnded"
 )
 
+// breakerEvents are the event types for changes to each circuit breaker state
+var breakerEvents = map[int]string{
+	breakerClosed:   CircuitClosed,
+	breakerHalfOpen: CircuitHalfOpen,
+	breakerOpen:     CircuitOpened,
+}
+
 // MonitorPoolOptions contains pool options as formatted in pool events
 type MonitorPoolOptions struct {
 	MaxPoolSize uint64 `json:"maxPoolSize"`
@@ -80,6 +108,7 @@ type Event struct {
 	ConnectionID uint64              `json:"connectionId"`
 	PoolOptions  *MonitorPoolOptions `json:"options"`
 	Reason       string              `json:"reason"`
+	Duration     time.Duration       `json:"duration"` // how long dials back off, for BackoffStarted
 }
 
 // Monitor is a function that allows the user to gain access to events occurring in the pool
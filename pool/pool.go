@@ -9,11 +9,10 @@ package pool
 import (
 	"context"
 	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"golang.org/x/sync/semaphore"
 )
 
 // ErrPoolConnected is returned from an attempt to connect an already connected pool
@@ -45,6 +44,13 @@ type poolConfig struct {
 	PoolMonitor      *Monitor
 	IdleTimeout      time.Duration // if set, determines how long to keep a connection if left unused
 	MaintainInterval time.Duration // for ResourcePool periodic element checks
+	MaxLifetime      time.Duration // if set, determines how long to keep a connection regardless of use
+	LifetimeJitter   time.Duration // up to how much earlier than MaxLifetime a connection may be closed
+	MaxRequests      uint64        // if set, determines how many times a connection can be checked out
+	Dial             DialConfig    // limits concurrent dials and backs off after they fail
+
+	HealthCheckInterval time.Duration // if set, idle connections are sent a noop this often
+	HealthCheckTimeout  time.Duration // how long a connection has to answer a health check
 }
 
 // pool is a wrapper of resource pool that follows the CMAP spec for connection pools
@@ -58,8 +64,22 @@ type pool struct {
 	connected   int32 // Must be accessed using the sync/atomic package.
 	nextid      uint64
 	opened      map[uint64]*connection // opened holds all of the currently open connections.
-	sem         *semaphore.Weighted
+	sem         *limiter
 	idleTimeout time.Duration // max allowed connection idleness
+
+	maxLifetime    time.Duration
+	lifetimeJitter time.Duration
+	maxRequests    uint64
+	dials          *dialGate
+
+	checkedOut      int64  // must be accessed using the sync/atomic package
+	created         uint64 // must be accessed using the sync/atomic package
+	closed          uint64 // must be accessed using the sync/atomic package
+	checkoutLatency latencySamples
+
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	healthCheckDone     chan struct{} // closed to stop health checks when the pool is disconnected
 	sync.Mutex
 }
 
@@ -77,6 +97,8 @@ func connectionExpiredFunc(v interface{}) bool {
 	switch {
 	case atomic.LoadInt32(&c.pool.connected) != connected:
 		c.expireReason = ReasonPoolClosed
+	case c.healthCheckFailed:
+		c.expireReason = ReasonHealthCheckFailed
 	case c.closed():
 		// A connection would only be closed if it encountered a network error during an operation and closed itself.
 		c.expireReason = ReasonConnectionErrored
@@ -84,6 +106,10 @@ func connectionExpiredFunc(v interface{}) bool {
 		c.expireReason = ReasonStale
 	case c.pool.connectionExpired(c):
 		c.expireReason = ReasonConnectionExpired
+	case c.pool.lifetimeExceeded(c):
+		c.expireReason = ReasonLifetimeExceeded
+	case c.pool.maxRequests > 0 && c.requests >= c.pool.maxRequests:
+		c.expireReason = ReasonMaxRequests
 	default:
 		return false
 	}
@@ -140,7 +166,23 @@ func newPool(config poolConfig, connOpts ...ConnectionOption) (*pool, error) {
 		connected: disconnected,
 		opened:    make(map[uint64]*connection),
 		opts:      opts,
-		sem:       semaphore.NewWeighted(int64(maxConns)),
+		sem:       newLimiter(int64(maxConns)),
+
+		maxLifetime:    config.MaxLifetime,
+		lifetimeJitter: config.LifetimeJitter,
+		maxRequests:    config.MaxRequests,
+
+		healthCheckInterval: config.HealthCheckInterval,
+		healthCheckTimeout:  config.HealthCheckTimeout,
+	}
+	pool.dials = newDialGate(config.Dial, func(e *Event) {
+		if pool.monitor != nil {
+			e.Address = pool.address.String()
+			pool.monitor.Event(e)
+		}
+	})
+	if pool.healthCheckTimeout == 0 {
+		pool.healthCheckTimeout = defaultHealthCheckTimeout
 	}
 	if config.IdleTimeout == 0 {
 		pool.idleTimeout = math.MaxInt64 * time.Nanosecond
@@ -192,12 +234,34 @@ func (p *pool) connectionExpired(c *connection) bool {
 	return c == nil || time.Now().After(c.expiresAfter)
 }
 
+// lifetimeExceeded checks if a given connection has been open for longer than its lifetime
+func (p *pool) lifetimeExceeded(c *connection) bool {
+	return !c.closesAt.IsZero() && time.Now().After(c.closesAt)
+}
+
+// lifetime returns how long a new connection can stay open, which is shortened by a random jitter so that the
+// connections made at the same time aren't all closed at once
+func (p *pool) lifetime() time.Duration {
+	jitter := p.lifetimeJitter
+	if jitter > p.maxLifetime {
+		jitter = p.maxLifetime
+	}
+	if jitter <= 0 {
+		return p.maxLifetime
+	}
+	return p.maxLifetime - time.Duration(rand.Int63n(int64(jitter)))
+}
+
 // connect puts the pool into the connected state, allowing it to be used and will allow items to begin being processed from the wait queue
 func (p *pool) connect() error {
 	if !atomic.CompareAndSwapInt32(&p.connected, disconnected, connected) {
 		return ErrPoolConnected
 	}
 	p.conns.initialize()
+	if p.healthCheckInterval > 0 {
+		p.healthCheckDone = make(chan struct{})
+		go p.healthCheckLoop(p.healthCheckInterval, p.healthCheckDone)
+	}
 	return nil
 }
 
@@ -211,6 +275,9 @@ func (p *pool) disconnect(ctx context.Context) error {
 		ctx = context.Background()
 	}
 
+	if p.healthCheckDone != nil {
+		close(p.healthCheckDone)
+	}
 	p.conns.Close()
 	atomic.AddUint64(&p.generation, 1)
 
@@ -279,6 +346,10 @@ func (p *pool) makeNewConnection() (*connection, string, error) {
 	c.poolID = atomic.AddUint64(&p.nextid, 1)
 	c.generation = atomic.LoadUint64(&p.generation)
 	c.expiresAfter = time.Now().Add(p.idleTimeout)
+	c.returned = time.Now()
+	if p.maxLifetime > 0 {
+		c.closesAt = time.Now().Add(p.lifetime())
+	}
 
 	if p.monitor != nil {
 		p.monitor.Event(&Event{
@@ -306,13 +377,42 @@ func (p *pool) makeNewConnection() (*connection, string, error) {
 	p.Lock()
 	p.opened[c.poolID] = c
 	p.Unlock()
+	atomic.AddUint64(&p.created, 1)
 
 	return c, "", nil
 
 }
 
-// Checkout returns a connection from the pool
+// waitHookKey is the context key of the function that checkouts call before they have to wait
+type waitHookKey struct{}
+
+// WithWaitHook returns a copy of ctx that makes checkouts with it call wait before they have to wait, either for a
+// connection to be returned to a full pool or for a new connection to be dialed. Checkouts that get an idle
+// connection right away don't call it. It may be called more than once per checkout.
+func WithWaitHook(ctx context.Context, wait func()) context.Context {
+	return context.WithValue(ctx, waitHookKey{}, wait)
+}
+
+// waiting calls the wait hook of ctx, if any
+func waiting(ctx context.Context) {
+	if wait, ok := ctx.Value(waitHookKey{}).(func()); ok {
+		wait()
+	}
+}
+
+// get checks out a connection from the pool, and records the checkout for stats
 func (p *pool) get(ctx context.Context) (*connection, error) {
+	start := time.Now()
+	c, err := p.checkout(ctx)
+	if err == nil {
+		atomic.AddInt64(&p.checkedOut, 1)
+		p.checkoutLatency.record(time.Since(start))
+	}
+	return c, err
+}
+
+// checkout returns a connection from the pool
+func (p *pool) checkout(ctx context.Context) (*connection, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -328,7 +428,11 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 		return nil, ErrPoolDisconnected
 	}
 
-	err := p.sem.Acquire(ctx, 1)
+	var err error
+	if !p.sem.TryAcquire() {
+		waiting(ctx)
+		err = p.sem.Acquire(ctx)
+	}
 	if err != nil {
 		if p.monitor != nil {
 			p.monitor.Event(&Event{
@@ -351,7 +455,7 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 					Reason:  ReasonPoolClosed,
 				})
 			}
-			p.sem.Release(1)
+			p.sem.Release()
 			return nil, ErrPoolDisconnected
 		}
 
@@ -359,21 +463,23 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 		if c, ok := connVal.(*connection); ok && connVal != nil {
 			// call connect if not connected
 			if atomic.LoadInt32(&c.connected) == initialized {
+				waiting(ctx)
 				c.connect(ctx)
 			}
 
 			err := c.wait()
 			if err != nil {
+				reason := connectErrorReason(err)
 				// Call removeConnection to remove the connection reference and emit a ConnectionClosed event.
-				_ = p.removeConnection(c, ReasonConnectionErrored)
+				_ = p.removeConnection(c, reason)
 				p.conns.decrementTotal()
-				p.sem.Release(1)
+				p.sem.Release()
 
 				if p.monitor != nil {
 					p.monitor.Event(&Event{
 						Type:    GetFailed,
 						Address: p.address.String(),
-						Reason:  ReasonConnectionErrored,
+						Reason:  reason,
 					})
 				}
 				return nil, err
@@ -398,15 +504,28 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 					Reason:  ReasonTimedOut,
 				})
 			}
-			p.sem.Release(1)
+			p.sem.Release()
 			return nil, ctx.Err()
 		default:
-			// The pool is empty, so we try to make a new connection. If incrementTotal fails, the resource pool has
-			// more resources than we previously thought, so we try to get a resource again.
+			// The pool is empty, so we try to make a new connection, unless dials are backing off after failing.
+			if p.dials.backingOff() {
+				if p.monitor != nil {
+					p.monitor.Event(&Event{
+						Type:    GetFailed,
+						Address: p.address.String(),
+						Reason:  ReasonBackingOff,
+					})
+				}
+				p.sem.Release()
+				return nil, ErrBackingOff
+			}
+			// If incrementTotal fails, the resource pool has more resources than we previously thought, so we try
+			// to get a resource again.
 			made := p.conns.incrementTotal()
 			if !made {
 				continue
 			}
+			waiting(ctx)
 			c, reason, err := p.makeNewConnection()
 
 			if err != nil {
@@ -420,7 +539,7 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 					})
 				}
 				p.conns.decrementTotal()
-				p.sem.Release(1)
+				p.sem.Release()
 				return nil, err
 			}
 
@@ -428,10 +547,11 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 			// wait for conn to be connected
 			err = c.wait()
 			if err != nil {
+				reason = connectErrorReason(err)
 				// Call removeConnection to remove the connection reference and fire a ConnectionClosedEvent.
-				_ = p.removeConnection(c, ReasonConnectionErrored)
+				_ = p.removeConnection(c, reason)
 				p.conns.decrementTotal()
-				p.sem.Release(1)
+				p.sem.Release()
 
 				if p.monitor != nil {
 					p.monitor.Event(&Event{
@@ -455,6 +575,28 @@ func (p *pool) get(ctx context.Context) (*connection, error) {
 	}
 }
 
+// resize changes the minimum number of idle connections and the maximum number of connections. When the maximum
+// shrinks, checkouts wait until enough connections have been returned, and connections over the maximum are closed
+// when they are returned.
+func (p *pool) resize(minSize, maxSize uint64) {
+	if maxSize == 0 {
+		maxSize = math.MaxInt64
+	}
+	p.sem.Resize(int64(maxSize))
+	p.conns.resize(minSize, maxSize)
+
+	if p.monitor != nil {
+		p.monitor.Event(&Event{
+			Type: Resized,
+			PoolOptions: &MonitorPoolOptions{
+				MaxPoolSize: maxSize,
+				MinPoolSize: minSize,
+			},
+			Address: p.address.String(),
+		})
+	}
+}
+
 // closeConnection closes a connection, not the pool itself. This method will actually closeConnection the connection,
 // making it unusable, to instead return the connection to the pool, use put.
 func (p *pool) closeConnection(c *connection) error {
@@ -481,6 +623,17 @@ func (p *pool) closeConnection(c *connection) error {
 	return nil
 }
 
+// connectErrorReason returns the monitoring reason for a connection that failed to connect with err
+func connectErrorReason(err error) string {
+	if IsAuthenticationError(err) {
+		return ReasonAuthenticationFailed
+	}
+	if err == ErrBackingOff {
+		return ReasonBackingOff
+	}
+	return ReasonConnectionErrored
+}
+
 // removeConnection removes a connection from the pool.
 func (p *pool) removeConnection(c *connection, reason string) error {
 	if c.pool != p {
@@ -494,6 +647,9 @@ func (p *pool) removeConnection(c *connection, reason string) error {
 		delete(p.opened, c.poolID)
 	}
 	p.Unlock()
+	if publishEvent {
+		atomic.AddUint64(&p.closed, 1)
+	}
 
 	if publishEvent && p.monitor != nil {
 		c.pool.monitor.Event(&Event{
@@ -510,7 +666,7 @@ func (p *pool) removeConnection(c *connection, reason string) error {
 // stale, and there is space in the cache, the connection is returned to the cache. This
 // assumes that the connection has already been counted in p.conns.totalSize.
 func (p *pool) put(c *connection) error {
-	defer p.sem.Release(1)
+	defer p.sem.Release()
 	if p.monitor != nil {
 		var cid uint64
 		var addr string
@@ -532,8 +688,11 @@ func (p *pool) put(c *connection) error {
 	if c.pool != p {
 		return ErrWrongPool
 	}
+	atomic.AddInt64(&p.checkedOut, -1)
 
 	c.expiresAfter = time.Now().Add(p.idleTimeout) // we really don't know if the connection was used; but this is a good guess
+	c.returned = time.Now()
+	c.requests++
 	_ = p.conns.Put(c)
 
 	return nil
@@ -4,28 +4,35 @@ import (
 	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/coinbase/memcachedbetween/protocol"
 )
 
-func startTcpServer(addr string) {
+// startTcpServer listens on addr before returning, so that tests can connect right away, and closes the
+// connections it accepts
+func startTcpServer(t *testing.T, addr string) {
 	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		panic(err)
-	}
-	defer l.Close()
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			panic(err)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				fmt.Println("request arrived")
+				conn.Close()
+			}(conn)
 		}
-		go func(conn net.Conn) {
-			fmt.Println("request arrived")
-			conn.Close()
-		}(conn)
-	}
+	}()
 }
 
 func TestPoolExpiredFn(t *testing.T) {
@@ -61,12 +68,43 @@ func TestPoolExpiredFn(t *testing.T) {
 	assert.Equal(t, ReasonConnectionExpired, conn.expireReason)
 }
 
+func TestRecyclingExpiredFn(t *testing.T) {
+	p, err := newPool(poolConfig{Address: "localhost:0000", MaxLifetime: time.Minute, LifetimeJitter: 10 * time.Second, MaxRequests: 2})
+	assert.NoError(t, err)
+	p.connected = connected
+
+	for i := 0; i < 100; i++ {
+		lifetime := p.lifetime()
+		assert.True(t, lifetime > 50*time.Second && lifetime <= time.Minute, lifetime)
+	}
+
+	conn, _, err := p.makeNewConnection()
+	assert.NoError(t, err)
+	conn.connected = connected
+	assert.True(t, conn.closesAt.After(time.Now().Add(50*time.Second)))
+	assert.False(t, connectionExpiredFunc(conn))
+
+	// busy connections are recycled once they are too old
+	conn.closesAt = time.Now()
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, connectionExpiredFunc(conn))
+	assert.Equal(t, ReasonLifetimeExceeded, conn.expireReason)
+
+	// or have been used too many times
+	conn.closesAt = time.Time{}
+	conn.requests = 1
+	assert.False(t, connectionExpiredFunc(conn))
+	conn.requests = 2
+	assert.True(t, connectionExpiredFunc(conn))
+	assert.Equal(t, ReasonMaxRequests, conn.expireReason)
+}
+
 // Tests the connectionExpiredFunc and the whole connection expiry
 func TestConnectionExpiry(t *testing.T) {
 	duration := 5 * time.Second
 
 	var address Address = "localhost:38888"
-	go startTcpServer(string(address))
+	startTcpServer(t, string(address))
 	config := poolConfig{
 		Address:          address,
 		MinPoolSize:      1,
@@ -98,7 +136,7 @@ func TestGoodConnectionDespiteInactivity(t *testing.T) {
 	duration := 5 * time.Second
 
 	var address Address = "localhost:38889"
-	go startTcpServer(string(address))
+	startTcpServer(t, string(address))
 	config := poolConfig{
 		Address:          address,
 		MinPoolSize:      1,
@@ -132,7 +170,7 @@ func TestGoodConnectionDespiteInactivity(t *testing.T) {
 // make sure connections never expire if IdleTimeout is not set
 func TestNoExpiryWhenNoIdleTimeout(t *testing.T) {
 	var address Address = "localhost:38899"
-	go startTcpServer(string(address))
+	startTcpServer(t, string(address))
 	config := poolConfig{
 		Address:          address,
 		MinPoolSize:      1,
@@ -170,3 +208,142 @@ func TestDefaultMaintainInterval(t *testing.T) {
 	assert.NoError(t, e)
 	assert.Equal(t, time.Minute, p.conns.maintainInterval)
 }
+
+func TestResize(t *testing.T) {
+	p, err := newPool(poolConfig{Address: startNoopServer(t, new(int32)), MaxPoolSize: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, p.connect())
+
+	timeout := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	first, err := p.get(context.Background())
+	assert.NoError(t, err)
+	_, err = p.get(timeout())
+	assert.Equal(t, ErrWaitQueueTimeout, err)
+
+	p.resize(0, 2)
+	second, err := p.get(timeout())
+	assert.NoError(t, err)
+	_, err = p.get(timeout())
+	assert.Equal(t, ErrWaitQueueTimeout, err)
+
+	// connections over the new maximum are closed when they are returned
+	p.resize(0, 1)
+	assert.NoError(t, p.put(first))
+	assert.Equal(t, uint64(1), p.conns.totalSize)
+	assert.Nil(t, p.conns.start)
+	_, err = p.get(timeout())
+	assert.Equal(t, ErrWaitQueueTimeout, err)
+	assert.NoError(t, p.put(second))
+	_, err = p.get(timeout())
+	assert.NoError(t, err)
+}
+
+func TestWaitHook(t *testing.T) {
+	p, err := newPool(poolConfig{Address: startNoopServer(t, new(int32)), MaxPoolSize: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, p.connect())
+
+	waits := 0
+	hooked := func(timeout time.Duration) context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		t.Cleanup(cancel)
+		return WithWaitHook(ctx, func() { waits++ })
+	}
+
+	// dialing a new connection waits, but checking out an idle one doesn't
+	c, err := p.get(hooked(time.Second))
+	assert.NoError(t, err)
+	assert.NotZero(t, waits)
+	assert.NoError(t, p.put(c))
+	waits = 0
+	c, err = p.get(hooked(time.Second))
+	assert.NoError(t, err)
+	assert.Zero(t, waits)
+
+	// waiting for a connection to be returned to a full pool calls it too
+	_, err = p.get(hooked(50 * time.Millisecond))
+	assert.Equal(t, ErrWaitQueueTimeout, err)
+	assert.NotZero(t, waits)
+}
+
+// startNoopServer starts a server that answers binary noops until hang is set
+func startNoopServer(t *testing.T, hang *int32) Address {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var header [protocol.HeaderLen]byte
+				for {
+					if _, err := io.ReadFull(conn, header[:]); err != nil {
+						return
+					}
+					h, _ := protocol.DecodeHeader(header[:])
+					if atomic.LoadInt32(hang) == 1 {
+						continue
+					}
+					res := protocol.NewResponse(h.Opcode, protocol.StatusNoError, h.Opaque, nil, nil, nil)
+					if _, err := conn.Write(res.Encode()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return Address(l.Addr().String())
+}
+
+func TestHealthCheck(t *testing.T) {
+	var hang int32
+	address := startNoopServer(t, &hang)
+
+	var mu sync.Mutex
+	events := map[string]int{}
+	monitor := &Monitor{Event: func(e *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[e.Type]++
+		if e.Type == ConnectionClosed {
+			events[e.Reason]++
+		}
+	}}
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return events[name]
+	}
+
+	p, err := newPool(poolConfig{
+		Address:             address,
+		MinPoolSize:         2,
+		MaxPoolSize:         2,
+		PoolMonitor:         monitor,
+		HealthCheckInterval: 20 * time.Millisecond,
+		HealthCheckTimeout:  20 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, p.connect())
+	defer func() { _ = p.disconnect(context.Background()) }()
+
+	assert.Eventually(t, func() bool { return count(HealthCheckSucceeded) >= 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, count(HealthCheckFailed))
+
+	// connections that don't answer are closed, and replaced by maintenance
+	atomic.StoreInt32(&hang, 1)
+	assert.Eventually(t, func() bool { return count(ReasonHealthCheckFailed) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, count(HealthCheckFailed))
+	p.conns.Lock()
+	assert.Equal(t, uint64(0), p.conns.totalSize)
+	p.conns.Unlock()
+}
@@ -157,11 +157,41 @@ func (rp *resourcePool) clearTotal() {
 	rp.totalSize = 0
 }
 
+// resize changes the minimum and maximum number of resources. The minimum is restored on the next maintenance.
+func (rp *resourcePool) resize(minSize, maxSize uint64) {
+	rp.Lock()
+	defer rp.Unlock()
+	rp.minSize = minSize
+	rp.maxSize = maxSize
+}
+
+// take removes the idle resources that match from the pool and returns them. They stay accounted for by
+// rp.totalSize, and must be given back with Put.
+func (rp *resourcePool) take(match func(interface{}) bool) []interface{} {
+	rp.Lock()
+	defer rp.Unlock()
+
+	var taken []interface{}
+	for curr := rp.start; curr != nil; curr = curr.next {
+		if match(curr.value) {
+			rp.remove(curr)
+			taken = append(taken, curr.value)
+		}
+	}
+	return taken
+}
+
 // Put puts the resource back into the pool if it will not exceed the max size of the pool.
 // This assumes that v has already been accounted for by rp.totalSize
 func (rp *resourcePool) Put(v interface{}) bool {
 	rp.Lock()
 	defer rp.Unlock()
+	if rp.maxSize > 0 && rp.totalSize > rp.maxSize {
+		// the pool has been resized to fewer resources than it holds
+		rp.closeFn(v)
+		rp.totalSize--
+		return false
+	}
 	if rp.expiredFn(v) {
 		rp.closeFn(v)
 		rp.totalSize--
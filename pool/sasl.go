@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+const saslPlainMechanism = "PLAIN"
+
+// maxSASLValueLength bounds the value of SASL responses, which only hold a short status message, so that a bad
+// response can't make the handshake allocate a large body
+const maxSASLValueLength = 1024
+
+// Credentials are the username and password used to authenticate connections
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsFunc returns the credentials to authenticate a new connection with.
+type CredentialsFunc func() (Credentials, error)
+
+// StaticCredentials returns a CredentialsFunc that always returns the given username and password.
+func StaticCredentials(username, password string) CredentialsFunc {
+	return func() (Credentials, error) {
+		return Credentials{Username: username, Password: password}, nil
+	}
+}
+
+// FileCredentials returns a CredentialsFunc that reads a username:password pair from the file at path. The file
+// is read for every new connection, so credentials can be rotated without a restart.
+func FileCredentials(path string) CredentialsFunc {
+	return func() (Credentials, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Credentials{}, err
+		}
+		parts := strings.SplitN(strings.TrimSpace(string(b)), ":", 2)
+		if len(parts) != 2 {
+			return Credentials{}, fmt.Errorf("credentials file %s is not in username:password format", path)
+		}
+		return Credentials{Username: parts[0], Password: parts[1]}, nil
+	}
+}
+
+// AuthenticationError is returned when the server rejects a connection's credentials
+type AuthenticationError struct {
+	Mechanism string
+	Status    protocol.Status
+	Message   string
+}
+
+// Error implements the error interface.
+func (e AuthenticationError) Error() string {
+	return fmt.Sprintf("sasl %s authentication failed with status %s: %s", e.Mechanism, e.Status, e.Message)
+}
+
+// IsAuthenticationError returns true if err was caused by the server rejecting a connection's credentials
+func IsAuthenticationError(err error) bool {
+	var authErr AuthenticationError
+	return errors.As(err, &authErr)
+}
+
+// saslPlainHandshaker returns a Handshaker that authenticates connections with SASL PLAIN, see
+// https://github.com/memcached/memcached/wiki/SASLHowto
+func saslPlainHandshaker(credentials CredentialsFunc) Handshaker {
+	return HandshakerFunc(func(ctx context.Context, address Address, nc net.Conn) error {
+		creds, err := credentials()
+		if err != nil {
+			return err
+		}
+
+		value := []byte("\x00" + creds.Username + "\x00" + creds.Password)
+		req := protocol.NewRequest(protocol.OpSASLAuth, 0, nil, []byte(saslPlainMechanism), value)
+		if _, err = nc.Write(req.Encode()); err != nil {
+			return err
+		}
+
+		var headerBuf [protocol.HeaderLen]byte
+		if _, err = io.ReadFull(nc, headerBuf[:]); err != nil {
+			return err
+		}
+		h, _ := protocol.DecodeHeader(headerBuf[:])
+		if h.Magic != protocol.MagicResponse || h.Opcode != protocol.OpSASLAuth {
+			return fmt.Errorf("unexpected sasl response for %s with magic 0x%02x", h.Opcode, h.Magic)
+		}
+		if herr := h.Validate(maxSASLValueLength); herr != nil {
+			return ConnectionError{Address: address.String(), Wrapped: herr, Message: "invalid sasl response"}
+		}
+		body := make([]byte, h.BodyLength)
+		if _, err = io.ReadFull(nc, body); err != nil {
+			return err
+		}
+
+		if h.Status != protocol.StatusNoError {
+			return AuthenticationError{Mechanism: saslPlainMechanism, Status: h.Status, Message: string(body[int(h.ExtrasLength)+int(h.KeyLength):])}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coinbase/memcachedbetween/protocol"
+)
+
+// startSASLServer accepts connections that authenticate with SASL PLAIN as user:pass
+func startSASLServer(t *testing.T) Address {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var hb [protocol.HeaderLen]byte
+				if _, err := io.ReadFull(conn, hb[:]); err != nil {
+					return
+				}
+				h, _ := protocol.DecodeHeader(hb[:])
+				wm := make([]byte, protocol.HeaderLen+int(h.BodyLength))
+				copy(wm, hb[:])
+				if _, err := io.ReadFull(conn, wm[protocol.HeaderLen:]); err != nil {
+					return
+				}
+				req, err := protocol.DecodeRequest(wm)
+				if err != nil {
+					return
+				}
+
+				res := protocol.NewResponse(req.Opcode, protocol.StatusNoError, req.Opaque, nil, nil, []byte("Authenticated"))
+				if req.Opcode != protocol.OpSASLAuth || string(req.Key) != "PLAIN" || string(req.Value) != "\x00user\x00pass" {
+					res = protocol.NewErrorResponse(req.Header, protocol.StatusAuthError, "Auth failure")
+				}
+				_, _ = conn.Write(res.Encode())
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	return Address(l.Addr().String())
+}
+
+func TestSASLPlain(t *testing.T) {
+	address := startSASLServer(t)
+
+	p, err := newPool(poolConfig{Address: address, MaxPoolSize: 1}, WithSASLPlain(StaticCredentials("user", "pass")))
+	assert.NoError(t, err)
+	assert.NoError(t, p.connect())
+
+	conn, err := p.get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, connected, conn.connected)
+	p.put(conn)
+}
+
+func TestSASLPlainFailure(t *testing.T) {
+	address := startSASLServer(t)
+
+	var events []*Event
+	monitor := &Monitor{Event: func(e *Event) { events = append(events, e) }}
+	p, err := newPool(poolConfig{Address: address, MaxPoolSize: 1, PoolMonitor: monitor}, WithSASLPlain(StaticCredentials("user", "wrong")))
+	assert.NoError(t, err)
+	assert.NoError(t, p.connect())
+
+	_, err = p.get(context.Background())
+	assert.True(t, IsAuthenticationError(err))
+
+	var authErr AuthenticationError
+	if assert.True(t, errors.As(err, &authErr)) {
+		assert.Equal(t, protocol.StatusAuthError, authErr.Status)
+		assert.Equal(t, "Auth failure", authErr.Message)
+	}
+
+	var failed *Event
+	for _, e := range events {
+		if e.Type == GetFailed {
+			failed = e
+		}
+	}
+	if assert.NotNil(t, failed) {
+		assert.Equal(t, ReasonAuthenticationFailed, failed.Reason)
+	}
+}
+
+func TestSASLPlainLargeResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var hb [protocol.HeaderLen]byte
+		if _, err := io.ReadFull(server, hb[:]); err != nil {
+			return
+		}
+		h, _ := protocol.DecodeHeader(hb[:])
+		if _, err := io.CopyN(ioutil.Discard, server, int64(h.BodyLength)); err != nil {
+			return
+		}
+		res := protocol.NewResponse(protocol.OpSASLAuth, protocol.StatusNoError, 0, nil, nil, nil).Encode()
+		res[8], res[9], res[10], res[11] = 0xff, 0xff, 0xff, 0xff // body length
+		_, _ = server.Write(res)
+	}()
+
+	err := saslPlainHandshaker(StaticCredentials("user", "pass")).Handshake(context.Background(), "memcached", client)
+	var connErr ConnectionError
+	assert.True(t, errors.As(err, &connErr), err)
+	assert.False(t, IsAuthenticationError(err))
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memcachedbetween")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+
+	credentials := FileCredentials(path)
+	_, err = credentials()
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("user:pa:ss\n"), 0600))
+	creds, err := credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "user", Password: "pa:ss"}, creds)
+
+	// credentials are re-read so that they can be rotated
+	assert.NoError(t, ioutil.WriteFile(path, []byte("other:pass"), 0600))
+	creds, err = credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "other", Password: "pass"}, creds)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("nopassword"), 0600))
+	_, err = credentials()
+	assert.Error(t, err)
+}
@@ -39,6 +39,7 @@ type ServerWrapper interface {
 	Connect() error
 	Disconnect(ctx context.Context) error
 	Connection(ctx context.Context) (ConnectionWrapper, error)
+	Stats() Stats
 }
 
 // Server is a single server within a topology.
@@ -48,7 +49,8 @@ type Server struct {
 	connectionstate int32
 
 	// connection related fields
-	pool *pool
+	pool    *pool
+	breaker *breaker // nil unless the circuit breaker is enabled
 }
 
 // ConnectServer creates a new Server and then initializes it using the
@@ -79,10 +81,17 @@ func NewServer(addr Address, opts ...ServerOption) (*Server, error) {
 	}
 
 	pc := poolConfig{
-		Address:     addr,
-		MinPoolSize: cfg.minConns,
-		MaxPoolSize: cfg.maxConns,
-		PoolMonitor: cfg.poolMonitor,
+		Address:        addr,
+		MinPoolSize:    cfg.minConns,
+		MaxPoolSize:    cfg.maxConns,
+		PoolMonitor:    cfg.poolMonitor,
+		MaxLifetime:    cfg.maxLifetime,
+		LifetimeJitter: cfg.lifetimeJitter,
+		MaxRequests:    cfg.maxRequests,
+		Dial:           cfg.dial,
+
+		HealthCheckInterval: cfg.healthCheckInterval,
+		HealthCheckTimeout:  cfg.healthCheckTimeout,
 	}
 	if cfg.idleTimeout > 0 {
 		pc.IdleTimeout = cfg.idleTimeout
@@ -90,11 +99,25 @@ func NewServer(addr Address, opts ...ServerOption) (*Server, error) {
 			pc.MaintainInterval = cfg.idleTimeout
 		}
 	}
+	if cfg.maxLifetime > 0 && cfg.maxLifetime < defaultMaintainInterval && (pc.MaintainInterval == 0 || cfg.maxLifetime < pc.MaintainInterval) {
+		pc.MaintainInterval = cfg.maxLifetime
+	}
 
 	s.pool, err = newPool(pc, cfg.connectionOpts...)
 	if err != nil {
 		return nil, err
 	}
+
+	if cfg.breaker.enabled() {
+		s.breaker = newBreaker(cfg.breaker, func(state int) {
+			if s.pool.monitor != nil {
+				s.pool.monitor.Event(&Event{
+					Type:    breakerEvents[state],
+					Address: s.address.String(),
+				})
+			}
+		})
+	}
 	return s, nil
 }
 
@@ -131,6 +154,12 @@ func (s *Server) Disconnect(ctx context.Context) error {
 	return nil
 }
 
+// Resize changes the minimum and maximum number of connections to the server. Connections that are checked out
+// while the server is resized count towards the previous maximum until they are returned.
+func (s *Server) Resize(minConns, maxConns uint64) {
+	s.pool.resize(minConns, maxConns)
+}
+
 // Connection gets a connection to the server.
 func (s *Server) Connection(ctx context.Context) (ConnectionWrapper, error) {
 	if s.pool.monitor != nil {
@@ -144,11 +173,60 @@ func (s *Server) Connection(ctx context.Context) (ConnectionWrapper, error) {
 		return nil, ErrServerClosed
 	}
 
+	if s.breaker != nil && !s.breaker.allow() {
+		if s.pool.monitor != nil {
+			s.pool.monitor.Event(&Event{
+				Type:    GetFailed,
+				Address: s.pool.address.String(),
+				Reason:  ReasonCircuitOpen,
+			})
+		}
+		return nil, ErrCircuitOpen
+	}
+
 	conn, err := s.pool.get(ctx)
 	if err != nil {
+		// Only failures to connect count against the breaker, not waiting for a connection from the pool.
+		var connErr ConnectionError
+		if s.breaker != nil {
+			s.breaker.done(errors.As(err, &connErr), true)
+		}
+		if s.cfg.clearOn&ConnectErrors != 0 && errors.As(err, &connErr) {
+			s.Clear()
+		}
 		// The error has already been handled by connection.connect, which calls Server.ProcessHandshakeError.
 		return nil, err
 	}
 
 	return &Connection{connection: conn}, nil
 }
+
+// Stats returns a snapshot of the state of the server's connection pool. It is safe to call concurrently with
+// checkouts.
+func (s *Server) Stats() Stats {
+	return s.pool.stats()
+}
+
+// Clear closes all of the server's connections without disconnecting it: idle connections right away, and
+// connections that are checked out when they are returned. New connections are dialed as needed.
+func (s *Server) Clear() {
+	s.pool.clear()
+}
+
+// Report records the outcome of a request made on conn, a connection from Connection, and must be called once for
+// every connection before it is returned. err is nil if the server answered, or the error reading or writing the
+// connection otherwise. Errors count towards the circuit breaker, and clear the pool if their class is configured
+// with WithClearOn, unless conn was already made before the last clear. Requests cancelled by the client count for
+// neither.
+func (s *Server) Report(conn ConnectionWrapper, err error) {
+	if s.breaker != nil {
+		s.breaker.done(!errors.Is(err, context.Canceled), err != nil)
+	}
+	if s.cfg.clearOn&classify(err) == 0 {
+		return
+	}
+	if c, ok := conn.(*Connection); ok && c.connection != nil && s.pool.stale(c.connection) {
+		return
+	}
+	s.Clear()
+}
@@ -16,6 +16,16 @@ type serverConfig struct {
 	minConns       uint64
 	poolMonitor    *Monitor
 	idleTimeout    time.Duration
+	maxLifetime    time.Duration
+	lifetimeJitter time.Duration
+	maxRequests    uint64
+
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+
+	breaker BreakerConfig
+	dial    DialConfig
+	clearOn ErrorClass
 }
 
 func newServerConfig(opts ...ServerOption) (*serverConfig, error) {
@@ -78,3 +88,76 @@ func WithIdleTimeout(fn func(time.Duration) time.Duration) ServerOption {
 		return nil
 	}
 }
+
+// WithMaxLifetime configures how long a connection is kept open, however busy it is, so that connections move to
+// a new address of the server eventually. Connections in use are closed when they are returned. If the lifetime is
+// 0, connections are kept open until they are idle for too long.
+func WithMaxLifetime(fn func(time.Duration) time.Duration) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.maxLifetime = fn(cfg.maxLifetime)
+		return nil
+	}
+}
+
+// WithLifetimeJitter configures up to how much earlier than the max lifetime each connection is closed, picked at
+// random so that connections made at the same time don't all have to be replaced at once.
+func WithLifetimeJitter(fn func(time.Duration) time.Duration) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.lifetimeJitter = fn(cfg.lifetimeJitter)
+		return nil
+	}
+}
+
+// WithMaxRequests configures how many times a connection can be checked out before it is closed. If max is 0,
+// connections can be used any number of times.
+func WithMaxRequests(fn func(uint64) uint64) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.maxRequests = fn(cfg.maxRequests)
+		return nil
+	}
+}
+
+// WithHealthCheckInterval configures how often idle connections are sent a noop, and closed if they don't answer.
+// If the interval is 0, idle connections aren't checked.
+func WithHealthCheckInterval(fn func(time.Duration) time.Duration) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.healthCheckInterval = fn(cfg.healthCheckInterval)
+		return nil
+	}
+}
+
+// WithHealthCheckTimeout configures how long an idle connection has to answer a health check. The default is 1
+// second.
+func WithHealthCheckTimeout(fn func(time.Duration) time.Duration) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.healthCheckTimeout = fn(cfg.healthCheckTimeout)
+		return nil
+	}
+}
+
+// WithCircuitBreaker configures the circuit breaker, which fails checkouts fast with ErrCircuitOpen after too many
+// requests to the server failed. The breaker is disabled unless a limit is set.
+func WithCircuitBreaker(fn func(BreakerConfig) BreakerConfig) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.breaker = fn(cfg.breaker)
+		return nil
+	}
+}
+
+// WithDialLimits configures how many connections can be dialed at once, and how long new connections fail fast with
+// ErrBackingOff after a dial failed. Dials aren't limited unless the limits are set.
+func WithDialLimits(fn func(DialConfig) DialConfig) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.dial = fn(cfg.dial)
+		return nil
+	}
+}
+
+// WithClearOn configures the classes of errors on the server's connections that clear its pool, closing all of the
+// connections made before the error. The pool is never cleared automatically unless a class is set.
+func WithClearOn(fn func(ErrorClass) ErrorClass) ServerOption {
+	return func(cfg *serverConfig) error {
+		cfg.clearOn = fn(cfg.clearOn)
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySampleSize is how many of the most recent checkouts the checkout latency percentiles are computed over
+const latencySampleSize = 1024
+
+// Stats is a snapshot of the state of a server's connection pool
+type Stats struct {
+	Opened     int    // open connections, whether idle or checked out
+	Idle       int    // connections in the pool waiting to be checked out
+	CheckedOut int    // connections checked out and not returned yet
+	Waiters    int    // checkouts waiting for a connection because the pool is at its maximum size
+	Generation uint64 // incremented whenever the pool is cleared
+	Created    uint64 // connections opened since the pool was created
+	Closed     uint64 // connections closed since the pool was created
+
+	CheckoutLatency Latencies // of the most recent successful checkouts
+}
+
+// Latencies are percentiles of a set of latencies, which are all 0 if there were none
+type Latencies struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// latencySamples keeps the most recent latencies in a ring buffer
+type latencySamples struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// record adds a latency, replacing the oldest one once the buffer is full
+func (l *latencySamples) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySampleSize {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySampleSize
+}
+
+// percentiles returns the percentiles of the recorded latencies
+func (l *latencySamples) percentiles() Latencies {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// nearest rank
+	rank := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return Latencies{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// stats returns a snapshot of the state of the pool
+func (p *pool) stats() Stats {
+	p.Lock()
+	opened := len(p.opened)
+	p.Unlock()
+
+	p.conns.Lock()
+	idle := p.conns.size
+	p.conns.Unlock()
+
+	return Stats{
+		Opened:          opened,
+		Idle:            int(idle),
+		CheckedOut:      int(atomic.LoadInt64(&p.checkedOut)),
+		Waiters:         int(p.sem.Waiting()),
+		Generation:      atomic.LoadUint64(&p.generation),
+		Created:         atomic.LoadUint64(&p.created),
+		Closed:          atomic.LoadUint64(&p.closed),
+		CheckoutLatency: p.checkoutLatency.percentiles(),
+	}
+}
@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	var l latencySamples
+	assert.Equal(t, Latencies{}, l.percentiles())
+
+	for i := 100; i > 0; i-- {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, Latencies{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}, l.percentiles())
+
+	// only the most recent latencies count
+	for i := 0; i < latencySampleSize; i++ {
+		l.record(time.Second)
+	}
+	assert.Equal(t, Latencies{P50: time.Second, P90: time.Second, P99: time.Second, Max: time.Second}, l.percentiles())
+}
+
+func TestStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	s, err := ConnectServer(Address(l.Addr().String()), WithMaxConnections(func(uint64) uint64 { return 1 }))
+	assert.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+	assert.Equal(t, Stats{}, s.Stats())
+
+	conn, err := s.Connection(context.Background())
+	assert.NoError(t, err)
+	stats := s.Stats()
+	assert.Equal(t, 1, stats.Opened)
+	assert.Equal(t, 0, stats.Idle)
+	assert.Equal(t, 1, stats.CheckedOut)
+	assert.Equal(t, uint64(1), stats.Created)
+	assert.True(t, stats.CheckoutLatency.Max > 0)
+
+	// a second checkout waits for the connection, while stats are read concurrently
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		second, err := s.Connection(context.Background())
+		assert.NoError(t, err)
+		_ = second.Close()
+		_ = second.Return()
+	}()
+	assert.Eventually(t, func() bool { return s.Stats().Waiters == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, conn.Return())
+	wg.Wait()
+
+	stats = s.Stats()
+	assert.Equal(t, 0, stats.Opened)
+	assert.Equal(t, 0, stats.CheckedOut)
+	assert.Equal(t, 0, stats.Waiters)
+	assert.Equal(t, uint64(1), stats.Created)
+	assert.Equal(t, uint64(1), stats.Closed)
+}
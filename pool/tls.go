@@ -0,0 +1,85 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+type tlsDialer struct {
+	dialer Dialer
+	config *tls.Config
+}
+
+// NewTLSDialer returns a Dialer that dials with dialer (or a default net.Dialer if nil) and then performs a TLS
+// client handshake using config. The server name is taken from the dialed address unless config sets one. Use it
+// with WithDialer.
+func NewTLSDialer(dialer Dialer, config *tls.Config) Dialer {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	return &tlsDialer{dialer: dialer, config: config}
+}
+
+// DialContext implements the Dialer interface.
+func (d *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	nc, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.config
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tc := tls.Client(nc, config)
+	if err = handshakeContext(ctx, tc); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// handshakeContext runs the TLS handshake on tc, aborting it if ctx is done first
+func handshakeContext(ctx context.Context, tc *tls.Conn) error {
+	dl, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := tc.SetDeadline(dl); err != nil {
+			return err
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock the handshake
+			_ = tc.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	err := tc.Handshake()
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if hasDeadline || ctx.Err() != nil {
+		return tc.SetDeadline(time.Time{})
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package pool
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedCertificate returns a certificate for 127.0.0.1 and a pool that trusts it
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "memcachedbetween"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"memcached.test"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestTLSDialer(t *testing.T) {
+	cert, roots := selfSignedCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("hello"))
+			}(conn)
+		}
+	}()
+
+	// the server name is taken from the address
+	d := NewTLSDialer(nil, &tls.Config{RootCAs: roots})
+	nc, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		buf := make([]byte, 5)
+		_, err = nc.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		_ = nc.Close()
+	}
+
+	// or overridden by the config
+	d = NewTLSDialer(nil, &tls.Config{RootCAs: roots, ServerName: "memcached.test"})
+	nc, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		_ = nc.Close()
+	}
+
+	d = NewTLSDialer(nil, &tls.Config{RootCAs: roots, ServerName: "other.test"})
+	_, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestTLSDialerTimeout(t *testing.T) {
+	// a server that never completes the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	d := NewTLSDialer(nil, &tls.Config{})
+	_, err = d.DialContext(ctx, "tcp", l.Addr().String())
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,204 @@
+// Package protocol implements encoding and decoding of memcached binary protocol messages, see
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderLen is the length of a binary protocol header
+const HeaderLen = 24
+
+// MaxKeyLength is the longest key memcached accepts
+const MaxKeyLength = 250
+
+// Magic bytes identifying requests and responses
+const (
+	MagicRequest  uint8 = 0x80
+	MagicResponse uint8 = 0x81
+)
+
+// ErrShortMessage is returned when decoding a buffer that is shorter than the message it contains
+var ErrShortMessage = errors.New("message is shorter than its header")
+
+// Header is a binary protocol message header
+type Header struct {
+	Magic        uint8
+	Opcode       Opcode
+	KeyLength    uint16
+	ExtrasLength uint8
+	DataType     uint8
+	Status       Status // the vbucket id in requests
+	BodyLength   uint32
+	Opaque       uint32
+	CAS          uint64
+}
+
+// DecodeHeader decodes the header at the start of b
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderLen {
+		return Header{}, ErrShortMessage
+	}
+	return Header{
+		Magic:        b[0],
+		Opcode:       Opcode(b[1]),
+		KeyLength:    binary.BigEndian.Uint16(b[2:4]),
+		ExtrasLength: b[4],
+		DataType:     b[5],
+		Status:       Status(binary.BigEndian.Uint16(b[6:8])),
+		BodyLength:   binary.BigEndian.Uint32(b[8:12]),
+		Opaque:       binary.BigEndian.Uint32(b[12:16]),
+		CAS:          binary.BigEndian.Uint64(b[16:24]),
+	}, nil
+}
+
+// Encode encodes the header into the start of b, which must be at least HeaderLen long
+func (h Header) Encode(b []byte) {
+	b[0] = h.Magic
+	b[1] = uint8(h.Opcode)
+	binary.BigEndian.PutUint16(b[2:4], h.KeyLength)
+	b[4] = h.ExtrasLength
+	b[5] = h.DataType
+	binary.BigEndian.PutUint16(b[6:8], uint16(h.Status))
+	binary.BigEndian.PutUint32(b[8:12], h.BodyLength)
+	binary.BigEndian.PutUint32(b[12:16], h.Opaque)
+	binary.BigEndian.PutUint64(b[16:24], h.CAS)
+}
+
+// ValueLength returns the length of the value in the message body
+func (h Header) ValueLength() uint32 {
+	return h.BodyLength - uint32(h.KeyLength) - uint32(h.ExtrasLength)
+}
+
+// Validate checks that the lengths in the header are consistent, and that the value is no longer than
+// maxValueLength if that is set
+func (h Header) Validate(maxValueLength int) *HeaderError {
+	switch {
+	case h.KeyLength > MaxKeyLength:
+		return &HeaderError{Header: h, Status: StatusInvalidArguments, Message: "Invalid arguments"}
+	case uint32(h.KeyLength)+uint32(h.ExtrasLength) > h.BodyLength:
+		return &HeaderError{Header: h, Status: StatusInvalidArguments, Message: "Invalid arguments"}
+	case maxValueLength > 0 && h.ValueLength() > uint32(maxValueLength):
+		return &HeaderError{Header: h, Status: StatusValueTooLarge, Message: "Too large."}
+	}
+	return nil
+}
+
+// HeaderError is returned when a header fails validation. The request should be answered with Status, and the
+// connection can only be used for further messages if Recoverable is set.
+type HeaderError struct {
+	Header      Header
+	Status      Status
+	Message     string
+	Recoverable bool
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("invalid header for %s: %s", e.Header.Opcode, e.Message)
+}
+
+// Message is a decoded binary protocol message. Extras, Key and Value are views into the buffer the message
+// was decoded from.
+type Message struct {
+	Header
+	Extras []byte
+	Key    []byte
+	Value  []byte
+}
+
+// Request is a binary protocol request
+type Request struct {
+	Message
+}
+
+// Response is a binary protocol response
+type Response struct {
+	Message
+}
+
+// DecodeRequest decodes the request in wm, without copying its body
+func DecodeRequest(wm []byte) (*Request, error) {
+	m, err := decodeMessage(wm, MagicRequest)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Message: m}, nil
+}
+
+// DecodeResponse decodes the response in wm, without copying its body
+func DecodeResponse(wm []byte) (*Response, error) {
+	m, err := decodeMessage(wm, MagicResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Message: m}, nil
+}
+
+func decodeMessage(wm []byte, magic uint8) (Message, error) {
+	h, err := DecodeHeader(wm)
+	if err != nil {
+		return Message{}, err
+	}
+	if h.Magic != magic {
+		return Message{}, &HeaderError{Header: h, Status: StatusInvalidArguments, Message: "Invalid magic"}
+	}
+	if herr := h.Validate(0); herr != nil {
+		return Message{}, herr
+	}
+	if uint64(len(wm)) < HeaderLen+uint64(h.BodyLength) {
+		return Message{}, ErrShortMessage
+	}
+
+	body := wm[HeaderLen : HeaderLen+int(h.BodyLength)]
+	keyStart := int(h.ExtrasLength)
+	valueStart := keyStart + int(h.KeyLength)
+	return Message{
+		Header: h,
+		Extras: body[:keyStart:keyStart],
+		Key:    body[keyStart:valueStart:valueStart],
+		Value:  body[valueStart:],
+	}, nil
+}
+
+// NewRequest returns a request with the given opcode, opaque and body
+func NewRequest(op Opcode, opaque uint32, extras, key, value []byte) *Request {
+	return &Request{Message: newMessage(MagicRequest, op, 0, opaque, extras, key, value)}
+}
+
+// NewResponse returns a response with the given opcode, status, opaque and body
+func NewResponse(op Opcode, status Status, opaque uint32, extras, key, value []byte) *Response {
+	return &Response{Message: newMessage(MagicResponse, op, status, opaque, extras, key, value)}
+}
+
+// NewErrorResponse returns a response to the request with header h, with an error status and message
+func NewErrorResponse(h Header, status Status, message string) *Response {
+	return NewResponse(h.Opcode, status, h.Opaque, nil, nil, []byte(message))
+}
+
+func newMessage(magic uint8, op Opcode, status Status, opaque uint32, extras, key, value []byte) Message {
+	return Message{
+		Header: Header{
+			Magic:        magic,
+			Opcode:       op,
+			KeyLength:    uint16(len(key)),
+			ExtrasLength: uint8(len(extras)),
+			Status:       status,
+			BodyLength:   uint32(len(extras) + len(key) + len(value)),
+			Opaque:       opaque,
+		},
+		Extras: extras,
+		Key:    key,
+		Value:  value,
+	}
+}
+
+// Encode returns the wire representation of the message
+func (m *Message) Encode() []byte {
+	wm := make([]byte, HeaderLen, HeaderLen+len(m.Extras)+len(m.Key)+len(m.Value))
+	m.Header.Encode(wm)
+	wm = append(wm, m.Extras...)
+	wm = append(wm, m.Key...)
+	return append(wm, m.Value...)
+}
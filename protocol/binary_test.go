@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	extras := []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0}
+	wm := NewRequest(OpSetQ, 42, extras, []byte("key"), []byte("value")).Encode()
+	assert.Equal(t, HeaderLen+len(extras)+3+5, len(wm))
+	assert.Equal(t, MagicRequest, wm[0])
+
+	req, err := DecodeRequest(wm)
+	assert.NoError(t, err)
+	assert.Equal(t, OpSetQ, req.Opcode)
+	assert.True(t, req.Opcode.Quiet())
+	assert.Equal(t, uint32(42), req.Opaque)
+	assert.Equal(t, extras, req.Extras)
+	assert.Equal(t, "key", string(req.Key))
+	assert.Equal(t, "value", string(req.Value))
+	assert.Equal(t, uint32(5), req.ValueLength())
+
+	// decoded fields are views into the buffer
+	wm[len(wm)-1] = 'E'
+	assert.Equal(t, "valuE", string(req.Value))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	wm := NewResponse(OpGet, StatusKeyNotFound, 1, nil, nil, []byte("Not found")).Encode()
+
+	_, err := DecodeRequest(wm)
+	assert.IsType(t, &HeaderError{}, err)
+
+	_, err = DecodeResponse(wm[:len(wm)-1])
+	assert.Equal(t, ErrShortMessage, err)
+
+	_, err = DecodeResponse(wm[:HeaderLen-1])
+	assert.Equal(t, ErrShortMessage, err)
+
+	res, err := DecodeResponse(wm)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusKeyNotFound, res.Status)
+	assert.Equal(t, "key_not_found", res.Status.String())
+}
+
+func TestValidate(t *testing.T) {
+	h := Header{Magic: MagicRequest, Opcode: OpSet, KeyLength: 3, ExtrasLength: 8, BodyLength: 111}
+	assert.Nil(t, h.Validate(100))
+
+	herr := h.Validate(99)
+	assert.Equal(t, StatusValueTooLarge, herr.Status)
+
+	h.BodyLength = 10
+	assert.Equal(t, StatusInvalidArguments, h.Validate(0).Status)
+
+	h.KeyLength = MaxKeyLength + 1
+	h.BodyLength = 1000
+	assert.Equal(t, StatusInvalidArguments, h.Validate(0).Status)
+}
+
+func TestOpcodeNames(t *testing.T) {
+	assert.Equal(t, "getkq", OpGetKQ.String())
+	assert.Equal(t, "0xff", Opcode(0xff).String())
+	assert.True(t, OpQuitQ.Quit())
+	assert.False(t, OpNoop.Quiet())
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import "fmt"
+
+// Opcode identifies the command of a binary protocol message
+type Opcode uint8
+
+// binary protocol opcodes
+const (
+	OpGet        Opcode = 0x00
+	OpSet        Opcode = 0x01
+	OpAdd        Opcode = 0x02
+	OpReplace    Opcode = 0x03
+	OpDelete     Opcode = 0x04
+	OpIncrement  Opcode = 0x05
+	OpDecrement  Opcode = 0x06
+	OpQuit       Opcode = 0x07
+	OpFlush      Opcode = 0x08
+	OpGetQ       Opcode = 0x09
+	OpNoop       Opcode = 0x0a
+	OpVersion    Opcode = 0x0b
+	OpGetK       Opcode = 0x0c
+	OpGetKQ      Opcode = 0x0d
+	OpAppend     Opcode = 0x0e
+	OpPrepend    Opcode = 0x0f
+	OpStat       Opcode = 0x10
+	OpSetQ       Opcode = 0x11
+	OpAddQ       Opcode = 0x12
+	OpReplaceQ   Opcode = 0x13
+	OpDeleteQ    Opcode = 0x14
+	OpIncrementQ Opcode = 0x15
+	OpDecrementQ Opcode = 0x16
+	OpQuitQ      Opcode = 0x17
+	OpFlushQ     Opcode = 0x18
+	OpAppendQ    Opcode = 0x19
+	OpPrependQ   Opcode = 0x1a
+	OpVerbosity  Opcode = 0x1b
+	OpTouch      Opcode = 0x1c
+	OpGAT        Opcode = 0x1d
+	OpGATQ       Opcode = 0x1e
+	OpSASLList   Opcode = 0x20
+	OpSASLAuth   Opcode = 0x21
+	OpSASLStep   Opcode = 0x22
+	OpGATK       Opcode = 0x23
+	OpGATKQ      Opcode = 0x24
+	OpConfigGet  Opcode = 0x60 // ElastiCache auto discovery
+)
+
+var opcodeNames = map[Opcode]string{
+	OpGet:        "get",
+	OpSet:        "set",
+	OpAdd:        "add",
+	OpReplace:    "replace",
+	OpDelete:     "delete",
+	OpIncrement:  "increment",
+	OpDecrement:  "decrement",
+	OpQuit:       "quit",
+	OpFlush:      "flush",
+	OpGetQ:       "getq",
+	OpNoop:       "noop",
+	OpVersion:    "version",
+	OpGetK:       "getk",
+	OpGetKQ:      "getkq",
+	OpAppend:     "append",
+	OpPrepend:    "prepend",
+	OpStat:       "stat",
+	OpSetQ:       "setq",
+	OpAddQ:       "addq",
+	OpReplaceQ:   "replaceq",
+	OpDeleteQ:    "deleteq",
+	OpIncrementQ: "incrementq",
+	OpDecrementQ: "decrementq",
+	OpQuitQ:      "quitq",
+	OpFlushQ:     "flushq",
+	OpAppendQ:    "appendq",
+	OpPrependQ:   "prependq",
+	OpVerbosity:  "verbosity",
+	OpTouch:      "touch",
+	OpGAT:        "gat",
+	OpGATQ:       "gatq",
+	OpSASLList:   "sasl_list_mechs",
+	OpSASLAuth:   "sasl_auth",
+	OpSASLStep:   "sasl_step",
+	OpGATK:       "gatk",
+	OpGATKQ:      "gatkq",
+	OpConfigGet:  "config_get",
+}
+
+// quietOpcodes are the opcodes for which the server only sends a response when there is something
+// interesting to report (a hit for gets, an error for everything else)
+var quietOpcodes = map[Opcode]bool{
+	OpGetQ:       true,
+	OpGetKQ:      true,
+	OpSetQ:       true,
+	OpAddQ:       true,
+	OpReplaceQ:   true,
+	OpDeleteQ:    true,
+	OpIncrementQ: true,
+	OpDecrementQ: true,
+	OpQuitQ:      true,
+	OpFlushQ:     true,
+	OpAppendQ:    true,
+	OpPrependQ:   true,
+	OpGATQ:       true,
+	OpGATKQ:      true,
+}
+
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", uint8(o))
+}
+
+// Quiet returns true if the server only responds to the opcode on a hit or an error
+func (o Opcode) Quiet() bool {
+	return quietOpcodes[o]
+}
+
+// Quit returns true for the opcodes that close the connection
+func (o Opcode) Quit() bool {
+	return o == OpQuit || o == OpQuitQ
+}
+
+// Status is the status of a binary protocol response
+type Status uint16
+
+// binary protocol response statuses
+const (
+	StatusNoError          Status = 0x0000
+	StatusKeyNotFound      Status = 0x0001
+	StatusKeyExists        Status = 0x0002
+	StatusValueTooLarge    Status = 0x0003
+	StatusInvalidArguments Status = 0x0004
+	StatusItemNotStored    Status = 0x0005
+	StatusNonNumeric       Status = 0x0006
+	StatusAuthError        Status = 0x0020
+	StatusAuthContinue     Status = 0x0021
+	StatusUnknownCommand   Status = 0x0081
+	StatusOutOfMemory      Status = 0x0082
+	StatusNotSupported     Status = 0x0083
+	StatusInternalError    Status = 0x0084
+	StatusBusy             Status = 0x0085
+	StatusTemporaryFailure Status = 0x0086
+)
+
+var statusNames = map[Status]string{
+	StatusNoError:          "no_error",
+	StatusKeyNotFound:      "key_not_found",
+	StatusKeyExists:        "key_exists",
+	StatusValueTooLarge:    "value_too_large",
+	StatusInvalidArguments: "invalid_arguments",
+	StatusItemNotStored:    "item_not_stored",
+	StatusNonNumeric:       "non_numeric",
+	StatusAuthError:        "auth_error",
+	StatusAuthContinue:     "auth_continue",
+	StatusUnknownCommand:   "unknown_command",
+	StatusOutOfMemory:      "out_of_memory",
+	StatusNotSupported:     "not_supported",
+	StatusInternalError:    "internal_error",
+	StatusBusy:             "busy",
+	StatusTemporaryFailure: "temporary_failure",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(s))
+}
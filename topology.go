@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/mongobetween/util"
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/config"
+	"github.com/coinbase/memcachedbetween/handlers"
+	"github.com/coinbase/memcachedbetween/hashring"
+	"github.com/coinbase/memcachedbetween/listener"
+	"github.com/coinbase/memcachedbetween/pool"
+)
+
+// drainTimeout is how long clients of a removed node's local proxy have to disconnect before they are closed
+const drainTimeout = 1 * time.Minute
+
+// topology keeps the local proxies and their upstream pools in sync with the nodes of the cluster. Nodes keep
+// the local proxy they were first assigned for as long as they are in the cluster, so clients aren't remapped
+// when other nodes are added or removed.
+type topology struct {
+	log          *zap.Logger
+	sd           *statsd.Client
+	cfg          *config.Config     // settings that need a restart to change
+	rc           *config.Reloadable // settings that are applied on reload
+	upstreamTLS  *tls.Config
+	listenerOpts []listener.Option
+	connect      func(sd *statsd.Client, node string) (*pool.Server, error) // connects the upstream pool of a node
+	wg           sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	nodes     []string                      // nodes of the last update
+	slots     map[string]int                // local proxy index of each node
+	listeners map[string]*listener.Listener // local proxy of each node, unless hashing
+	draining  map[int]*listener.Listener    // proxies of removed nodes that are still shutting down
+	hashing   *listener.Listener            // the single local proxy when hashing
+	servers   map[string]*pool.Server       // upstream pool of each node
+
+	route   atomic.Value           // handlers.Router of the hashing proxy
+	configs handlers.ClusterConfig // advertised by the local config endpoint
+}
+
+func newTopology(log *zap.Logger, sd *statsd.Client, rc *config.Reloadable, upstreamTLS *tls.Config) (*topology, error) {
+	cfg := rc.Get()
+	listenTLS, err := cfg.ListenTLS.ServerConfig(func(err error) {
+		log.Error("Failed to reload listener TLS certificates", zap.Error(err))
+		_ = sd.Incr("tls_reload_failure", rc.Get().StatsdTags, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var listenerOpts []listener.Option
+	if listenTLS != nil {
+		listenerOpts = append(listenerOpts, listener.WithTLS(listenTLS))
+	}
+
+	t := &topology{
+		log:          log,
+		sd:           sd,
+		cfg:          cfg,
+		rc:           rc,
+		upstreamTLS:  upstreamTLS,
+		listenerOpts: listenerOpts,
+		connect: func(sd *statsd.Client, node string) (*pool.Server, error) {
+			return connectServer(rc, sd, upstreamTLS, node)
+		},
+
+		slots:     map[string]int{},
+		listeners: map[string]*listener.Listener{},
+		draining:  map[int]*listener.Listener{},
+		servers:   map[string]*pool.Server{},
+	}
+	return t, nil
+}
+
+// update adds local proxies for nodes that are new, and drains the proxies of nodes that are no longer listed.
+// Every discovery source updates the topology whenever it reads the nodes, so nodes that haven't changed since the
+// last update are ignored here. If the update fails, it is applied again with the next nodes that are read.
+func (t *topology) update(nodes []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || sameNodes(nodes, t.nodes) {
+		return nil
+	}
+	if t.nodes != nil {
+		t.log.Info("Nodes changed", zap.Strings("servers", nodes))
+	}
+
+	var err error
+	if t.cfg.Hashing != "" {
+		err = t.updateHashing(nodes)
+	} else {
+		err = t.updateListeners(nodes)
+	}
+	t.configs.Set(t.configsJoined())
+	if err != nil {
+		return err
+	}
+	t.nodes = nodes
+	return nil
+}
+
+// updateListeners drains the local proxies of nodes that are no longer listed, and adds local proxies for nodes
+// that don't have one yet. A node whose proxy can't be added doesn't get a slot, so it is added again on the next
+// update, and the other nodes are still added.
+func (t *topology) updateListeners(nodes []string) error {
+	listed := map[string]bool{}
+	for _, node := range nodes {
+		listed[node] = true
+	}
+	for node, l := range t.listeners {
+		if listed[node] {
+			continue
+		}
+		t.log.Info("Removing node", zap.String("upstream", node))
+		t.drain(t.slots[node], l)
+		delete(t.listeners, node)
+		delete(t.servers, node)
+		delete(t.slots, node)
+	}
+
+	var failed error
+	for _, node := range nodes {
+		if _, ok := t.slots[node]; ok {
+			continue
+		}
+		index := t.freeSlot()
+		l, err := t.nodeListener(node, index)
+		if err != nil {
+			t.log.Error("Failed to add local proxy", zap.String("upstream", node), zap.Error(err))
+			failed = err
+			continue
+		}
+		t.slots[node] = index
+		t.listeners[node] = l
+		t.start(l)
+	}
+	return failed
+}
+
+// sameNodes returns true if a and b list the same nodes in the same order, which is the order they are hashed in
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return a != nil
+}
+
+// updateHashing connects pools for nodes that are new to the hashing proxy, swaps in a ring over nodes, and then
+// disconnects the pools of nodes that are no longer listed. Pools stay connected until a ring without their node
+// has been swapped in, so a failed update leaves the previous ring working.
+func (t *topology) updateHashing(nodes []string) error {
+	local, _ := localAddress(t.cfg, 0)
+	sdWith, err := util.StatsdWithTags(t.sd, []string{fmt.Sprintf("local:%s", local)})
+	if err != nil {
+		return err
+	}
+
+	servers := make([]*pool.Server, len(nodes))
+	for i, node := range nodes {
+		if m, ok := t.servers[node]; ok {
+			servers[i] = m
+			continue
+		}
+		sdUpstream, err := util.StatsdWithTags(sdWith, []string{fmt.Sprintf("upstream:%s", node)})
+		if err != nil {
+			return err
+		}
+		if servers[i], err = t.connect(sdUpstream, node); err != nil {
+			return err
+		}
+		t.servers[node] = servers[i]
+	}
+
+	ring, err := hashring.New(t.cfg.Hashing, nodes)
+	if err != nil {
+		return err
+	}
+	t.route.Store(handlers.HashRouter(ring, servers))
+
+	listed := map[string]bool{}
+	for _, node := range nodes {
+		listed[node] = true
+	}
+	for node, m := range t.servers {
+		if listed[node] {
+			continue
+		}
+		t.log.Info("Removing node", zap.String("upstream", node))
+		delete(t.servers, node)
+		m := m
+		go func() {
+			// requests that were routed before the swap have until the timeout to finish
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			_ = m.Disconnect(ctx)
+		}()
+	}
+
+	if t.hashing == nil {
+		route := func(key []byte) *pool.Server {
+			return t.route.Load().(handlers.Router)(key)
+		}
+		logWith := t.log.With(zap.String("local", local), zap.String("hashing", string(t.cfg.Hashing)))
+		t.hashing, err = commandListener(logWith, t.sd, sdWith, t.rc, local, route, t.hashingServers, t.listenerOpts)
+		if err != nil {
+			return err
+		}
+		t.start(t.hashing)
+	}
+	return nil
+}
+
+// hashingServers returns the pools of the hashing proxy, which are all of the pools when hashing
+func (t *topology) hashingServers() []*pool.Server {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var servers []*pool.Server
+	for _, m := range t.servers {
+		servers = append(servers, m)
+	}
+	return servers
+}
+
+// nodeListener creates the local proxy with the given index for node, and connects its upstream pool
+func (t *topology) nodeListener(node string, index int) (*listener.Listener, error) {
+	local, _ := localAddress(t.cfg, index)
+	logWith := t.log.With(zap.String("upstream", node), zap.String("local", local))
+	sdWith, err := util.StatsdWithTags(t.sd, []string{fmt.Sprintf("upstream:%s", node), fmt.Sprintf("local:%s", local)})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := t.connect(sdWith, node)
+	if err != nil {
+		return nil, err
+	}
+	l, err := commandListener(logWith, t.sd, sdWith, t.rc, local, handlers.SingleServer(m), func() []*pool.Server { return []*pool.Server{m} }, t.listenerOpts)
+	if err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		_ = m.Disconnect(ctx)
+		return nil, err
+	}
+	t.servers[node] = m
+	return l, nil
+}
+
+// resize applies the current pool sizes to the upstream pool of each node
+func (t *topology) resize() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg := t.rc.Get()
+	for node, m := range t.servers {
+		u := cfg.Upstream(node)
+		m.Resize(u.MinPoolSize, u.MaxPoolSize)
+	}
+}
+
+// freeSlot returns the lowest local proxy index that isn't used by a node, or by a proxy that is still draining
+func (t *topology) freeSlot() int {
+	used := map[int]bool{}
+	for _, index := range t.slots {
+		used[index] = true
+	}
+	for index := range t.draining {
+		used[index] = true
+	}
+	index := 0
+	for used[index] {
+		index++
+	}
+	return index
+}
+
+// drain stops l from accepting connections, and closes the remaining connections after drainTimeout. The index
+// is reused once l has shut down.
+func (t *topology) drain(index int, l *listener.Listener) {
+	t.draining[index] = l
+	l.Shutdown()
+	time.AfterFunc(drainTimeout, l.Kill)
+}
+
+// start runs l in the background, and waits for it in wait. If l is draining, its index is freed once it stops.
+func (t *topology) start(l *listener.Listener) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		err := l.Run()
+		if err != nil {
+			t.log.Error("Error", zap.Error(err))
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for index, d := range t.draining {
+			if d == l {
+				delete(t.draining, index)
+			}
+		}
+	}()
+}
+
+// configsJoined returns the local proxies in the format of the nodes line of a config get cluster response
+func (t *topology) configsJoined() string {
+	if t.cfg.Hashing != "" {
+		_, config := localAddress(t.cfg, 0)
+		return config
+	}
+
+	var indexes []int
+	for _, index := range t.slots {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var configs []string
+	for _, index := range indexes {
+		_, config := localAddress(t.cfg, index)
+		configs = append(configs, config)
+	}
+	return strings.Join(configs, " ")
+}
+
+// each calls f with every local proxy, including proxies that are draining
+func (t *topology) each(f func(l *listener.Listener)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, l := range t.listeners {
+		f(l)
+	}
+	for _, l := range t.draining {
+		f(l)
+	}
+	if t.hashing != nil {
+		f(t.hashing)
+	}
+}
+
+// shutdown stops updates and shuts down every local proxy
+func (t *topology) shutdown() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.each((*listener.Listener).Shutdown)
+}
+
+// kill force closes the connections of every local proxy
+func (t *topology) kill() {
+	t.each((*listener.Listener).Kill)
+}
+
+// wait blocks until every local proxy has shut down
+func (t *topology) wait() {
+	t.wg.Wait()
+}
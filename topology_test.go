@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/coinbase/memcachedbetween/config"
+	"github.com/coinbase/memcachedbetween/hashring"
+	"github.com/coinbase/memcachedbetween/pool"
+)
+
+// startTopology returns a topology with local proxies on unix sockets, whose upstream pools fail to connect for
+// the nodes in failing
+func startTopology(t *testing.T, hashing hashring.Algorithm, failing map[string]bool) *topology {
+	dir, err := ioutil.TempDir("", "memcachedbetween")
+	assert.NoError(t, err)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/memcached",
+		LocalSocketSuffix: ".sock",
+		Unlink:            true,
+		Hashing:           hashing,
+		MaxPoolSize:       1,
+	}
+	rc := config.NewReloadable(cfg)
+
+	top, err := newTopology(zap.NewNop(), sd, rc, nil)
+	assert.NoError(t, err)
+	top.connect = func(sd *statsd.Client, node string) (*pool.Server, error) {
+		if failing[node] {
+			return nil, errors.New("failed to connect")
+		}
+		return connectServer(rc, sd, nil, node)
+	}
+	t.Cleanup(func() {
+		top.shutdown()
+		top.wait()
+		_ = os.RemoveAll(dir)
+	})
+	return top
+}
+
+func TestUpdateRetriesFailedNode(t *testing.T) {
+	failing := map[string]bool{"b:11211": true}
+	top := startTopology(t, "", failing)
+
+	assert.Error(t, top.update([]string{"a:11211", "b:11211"}))
+	assert.Equal(t, map[string]int{"a:11211": 0}, top.slots)
+	assert.NotContains(t, top.servers, "b:11211")
+	_, a := localAddress(top.cfg, 0)
+	_, nodes := top.configs.Get()
+	assert.Equal(t, a, nodes)
+
+	// the same nodes are applied again, and the failed node gets the next slot
+	failing["b:11211"] = false
+	assert.NoError(t, top.update([]string{"a:11211", "b:11211"}))
+	assert.Equal(t, map[string]int{"a:11211": 0, "b:11211": 1}, top.slots)
+	assert.Contains(t, top.listeners, "b:11211")
+	assert.Contains(t, top.servers, "b:11211")
+	_, b := localAddress(top.cfg, 1)
+	_, nodes = top.configs.Get()
+	assert.Equal(t, a+" "+b, nodes)
+}
+
+func TestUpdateHashingRetriesFailedNode(t *testing.T) {
+	failing := map[string]bool{"c:11211": true}
+	top := startTopology(t, hashring.Ketama, failing)
+
+	assert.NoError(t, top.update([]string{"a:11211", "b:11211"}))
+	b := top.servers["b:11211"]
+
+	// the removed node stays connected until a ring without it is swapped in
+	assert.Error(t, top.update([]string{"a:11211", "c:11211"}))
+	assert.Contains(t, top.servers, "b:11211")
+
+	failing["c:11211"] = false
+	assert.NoError(t, top.update([]string{"a:11211", "c:11211"}))
+	assert.NotContains(t, top.servers, "b:11211")
+	assert.Contains(t, top.servers, "c:11211")
+	assert.Eventually(t, func() bool {
+		_, err := b.Connection(context.Background())
+		return errors.Is(err, pool.ErrServerClosed)
+	}, time.Second, time.Millisecond)
+}